@@ -3,11 +3,59 @@ package main
 import (
 	"banking/mongodb"
 	"banking/server"
+	"fmt"
+	"log"
 	"os"
+	"time"
 )
 
 func main() {
 	mongodb.Init()
+
+	switch os.Args[1] {
+	case "migrate":
+		if err := mongodb.Migrate(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "reset-password":
+		// banking reset-password <username> <password>
+		if len(os.Args) != 4 {
+			log.Fatal("usage: banking reset-password <username> <password>")
+		}
+		if err := mongodb.SetPassword(os.Args[2], os.Args[3]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "load-rates":
+		// banking load-rates <file.json>
+		if len(os.Args) != 3 {
+			log.Fatal("usage: banking load-rates <file.json>")
+		}
+		count, err := mongodb.LoadExchangeRates(os.Args[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("loaded %d exchange rates\n", count)
+		return
+	case "reconcile":
+		discrepancies, err := mongodb.ReconcileAccounts()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, d := range discrepancies {
+			fmt.Printf("%s: balance %s %s, ledger %s %s\n", d.Account, d.Balance, d.Balance.Currency, d.Ledger, d.Ledger.Currency)
+		}
+		if len(discrepancies) > 0 {
+			os.Exit(1)
+		}
+		fmt.Println("all accounts match the ledger")
+		return
+	}
+
+	go mongodb.RunExpiry(time.Minute)
+	mongodb.ReceiptPrefix = os.Getenv("RECEIPT_PREFIX")
+
 	port := os.Args[1]
 	server.RunServer(port)
 }
@@ -0,0 +1,294 @@
+package mongodb
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"time"
+)
+
+// limits in units of the account's currency: any single deposit, withdrawal
+// or transfer, all withdrawals and transfers out of an account in a day, and
+// all deposits into it in a day
+var (
+	MaxOperationAmount = "10000"
+	MaxDailyOutgoing   = "20000"
+	MaxDailyIncoming   = "20000"
+)
+
+var MaxMemoLength = 140
+
+func accountOf(ctx context.Context, username string) (Account, error) {
+	user, err := getUser(ctx, username)
+	if err != nil {
+		return Account{}, err
+	}
+	return getAccount(ctx, user.AccountId)
+}
+
+// checkMovement validates an amount moved in or out of account.
+func checkMovement(account Account, amount Money, memo string) error {
+	if amount.Amount <= 0 {
+		return ErrInvalidAmount
+	}
+	if len(memo) > MaxMemoLength {
+		return ErrInvalidMemo
+	}
+	if amount.Currency.orDefault() != account.Currency() {
+		return fmt.Errorf("%w: account is in %s", ErrInvalidCurrency, account.Currency())
+	}
+
+	max, err := ParseMoney(MaxOperationAmount, account.Currency())
+	if err != nil {
+		return err
+	}
+	if c, err := amount.Cmp(max); err != nil {
+		return err
+	} else if c > 0 {
+		return fmt.Errorf("%w: at most %s per operation", ErrLimitExceeded, max)
+	}
+
+	return nil
+}
+
+// movedToday is what came into an account, or went out of it, since midnight
+// with entries of kinds.
+func movedToday(ctx context.Context, account Account, kinds []LedgerKind, incoming bool) (Money, error) {
+	y, m, d := time.Now().Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+
+	sign := bson.M{"$lt": 0}
+	if incoming {
+		sign = bson.M{"$gt": 0}
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"postings.account": account.Id,
+			"created_at":       bson.M{"$gte": midnight},
+			"kind":             bson.M{"$in": kinds},
+		}}},
+		{{Key: "$unwind", Value: "$postings"}},
+		{{Key: "$match", Value: bson.M{
+			"postings.account":         account.Id,
+			"postings.amount.currency": account.Currency(),
+			"postings.amount.amount":   sign,
+		}}},
+		{{Key: "$group", Value: bson.M{"_id": nil, "total": bson.M{"$sum": "$postings.amount.amount"}}}},
+	}
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Ledger)
+
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return Money{}, err
+	}
+
+	var rows []struct {
+		Total primitive.Decimal128 `bson:"total"`
+	}
+	if err = cursor.All(ctx, &rows); err != nil {
+		return Money{}, err
+	}
+	if len(rows) == 0 {
+		return NewMoney(0, account.Currency()), nil
+	}
+
+	total, err := ParseMoney(rows[0].Total.String(), account.Currency())
+	if err != nil {
+		return Money{}, err
+	}
+	if incoming {
+		return total, nil
+	}
+	return total.Neg(), nil
+}
+
+// checkLimit tells whether amount fits in what is left of max after moved.
+func checkLimit(moved Money, amount Money, max Money) error {
+	total, err := moved.Add(amount)
+	if err != nil {
+		return err
+	}
+	if c, err := total.Cmp(max); err != nil {
+		return err
+	} else if c > 0 {
+		return fmt.Errorf("%w: at most %s a day", ErrLimitExceeded, max)
+	}
+	return nil
+}
+
+// checkDailyLimit keeps withdrawals and transfers out of an account, or
+// deposits into it when incoming, within their limit for the day.
+func checkDailyLimit(ctx context.Context, account Account, amount Money, incoming bool) error {
+	limit, kinds := MaxDailyOutgoing, []LedgerKind{LedgerWithdrawal, LedgerTransfer}
+	if incoming {
+		limit, kinds = MaxDailyIncoming, []LedgerKind{LedgerDeposit}
+	}
+
+	max, err := ParseMoney(limit, account.Currency())
+	if err != nil {
+		return err
+	}
+	moved, err := movedToday(ctx, account, kinds, incoming)
+	if err != nil {
+		return err
+	}
+	return checkLimit(moved, amount, max)
+}
+
+// moveMoney runs a deposit, withdrawal or transfer of the account of username
+// in a transaction and returns it as a line of that account's statement.
+func moveMoney(session Session, username string, move func(ctx mongo.SessionContext, account Account) (LedgerEntry, error)) (StatementLine, error) {
+	var line StatementLine
+	err := RunTransaction(func(sessCtx mongo.SessionContext) error {
+		account, err := accountOf(sessCtx, username)
+		if err != nil {
+			return err
+		}
+
+		entry, err := move(sessCtx, account)
+		if err != nil {
+			return err
+		}
+		entry.CreatedBy = session.Username
+		if err = recordEntry(sessCtx, &entry); err != nil {
+			return err
+		}
+
+		line, err = statementLine(entry, account.Id)
+		return err
+	})
+	if err != nil {
+		return StatementLine{}, err
+	}
+
+	return line, nil
+}
+
+// Deposit puts cash taken at the counter into the account of username. Only
+// admins and managers take deposits.
+func Deposit(session Session, username string, amount Money, memo string) (StatementLine, error) {
+	if session.Profile != ProfileTypeAdmin && session.Profile != ProfileTypeManager {
+		return StatementLine{}, ErrForbidden
+	}
+
+	return moveMoney(session, username, func(ctx mongo.SessionContext, account Account) (LedgerEntry, error) {
+		if err := checkMovement(account, amount, memo); err != nil {
+			return LedgerEntry{}, err
+		}
+		if err := checkDailyLimit(ctx, account, amount, true); err != nil {
+			return LedgerEntry{}, err
+		}
+		if err := UpdateAccount(ctx, account.Id, amount); err != nil {
+			return LedgerEntry{}, err
+		}
+
+		return LedgerEntry{
+			Kind: LedgerDeposit,
+			Memo: memo,
+			Postings: []Posting{
+				{Account: account.Id, Amount: amount},
+				{Account: SystemCash, Amount: amount.Neg()},
+			},
+		}, nil
+	})
+}
+
+// Withdraw pays out cash from the caller's account, within its balance and
+// credit limit.
+func Withdraw(session Session, amount Money, memo string) (StatementLine, error) {
+	return moveMoney(session, session.Username, func(ctx mongo.SessionContext, account Account) (LedgerEntry, error) {
+		if err := checkMovement(account, amount, memo); err != nil {
+			return LedgerEntry{}, err
+		}
+		if err := checkDailyLimit(ctx, account, amount, false); err != nil {
+			return LedgerEntry{}, err
+		}
+		if err := UpdateAccount(ctx, account.Id, amount.Neg()); err != nil {
+			return LedgerEntry{}, err
+		}
+
+		return LedgerEntry{
+			Kind: LedgerWithdrawal,
+			Memo: memo,
+			Postings: []Posting{
+				{Account: account.Id, Amount: amount.Neg()},
+				{Account: SystemCash, Amount: amount},
+			},
+		}, nil
+	})
+}
+
+// Transfer moves amount, in the caller's currency, from the caller's account
+// to the account of username, converted if that one is in another currency.
+func Transfer(session Session, username string, amount Money, memo string) (StatementLine, error) {
+	if username == session.Username {
+		return StatementLine{}, ErrSameAccount
+	}
+
+	return moveMoney(session, session.Username, func(ctx mongo.SessionContext, account Account) (LedgerEntry, error) {
+		if err := checkMovement(account, amount, memo); err != nil {
+			return LedgerEntry{}, err
+		}
+		if err := checkDailyLimit(ctx, account, amount, false); err != nil {
+			return LedgerEntry{}, err
+		}
+
+		to, err := accountOf(ctx, username)
+		if err != nil {
+			return LedgerEntry{}, err
+		}
+		if to.Id == account.Id {
+			return LedgerEntry{}, ErrSameAccount
+		}
+
+		credit := amount
+		if to.Currency() != account.Currency() {
+			if credit, _, err = convert(ctx, amount, to.Currency()); err != nil {
+				return LedgerEntry{}, err
+			}
+		}
+
+		if err := UpdateAccount(ctx, account.Id, amount.Neg()); err != nil {
+			return LedgerEntry{}, err
+		}
+		if err := UpdateAccount(ctx, to.Id, credit); err != nil {
+			return LedgerEntry{}, err
+		}
+
+		return LedgerEntry{
+			Kind: LedgerTransfer,
+			Memo: memo,
+			Postings: []Posting{
+				{Account: account.Id, Amount: amount.Neg()},
+				{Account: to.Id, Amount: credit},
+			},
+		}, nil
+	})
+}
+
+// SetCreditLimit sets how far below zero the account of username may go, in
+// the account's currency. It returns the previous limit.
+func SetCreditLimit(username string, limit Money) (Money, error) {
+	if limit.IsNegative() {
+		return Money{}, ErrInvalidCreditLimit
+	}
+
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	account, err := accountOf(ctx, username)
+	if err != nil {
+		return Money{}, err
+	}
+	if limit.Currency.orDefault() != account.Currency() {
+		return Money{}, fmt.Errorf("%w: account is in %s", ErrInvalidCurrency, account.Currency())
+	}
+
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Accounts)
+	update := bson.M{"$set": bson.M{"credit_limit": NewMoney(limit.Amount, account.Currency())}}
+	if _, err := collection.UpdateOne(ctx, bson.M{"id": account.Id}, update); err != nil {
+		return Money{}, err
+	}
+
+	return account.CreditLimit, nil
+}
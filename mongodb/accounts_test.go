@@ -0,0 +1,93 @@
+package mongodb
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCheckMovement(t *testing.T) {
+	account := Account{Id: "a", Balance: ron(0)}
+
+	tests := []struct {
+		name    string
+		amount  Money
+		memo    string
+		wantErr error
+	}{
+		{name: "ok", amount: ron(1000), memo: "rent"},
+		{name: "at the operation limit", amount: ron(1000000)},
+		{name: "over the operation limit", amount: ron(1000001), wantErr: ErrLimitExceeded},
+		{name: "zero", amount: ron(0), wantErr: ErrInvalidAmount},
+		{name: "negative", amount: ron(-1), wantErr: ErrInvalidAmount},
+		{name: "other currency", amount: Money{1000, CurrencyEUR}, wantErr: ErrInvalidCurrency},
+		{name: "long memo", amount: ron(1000), memo: strings.Repeat("x", MaxMemoLength+1), wantErr: ErrInvalidMemo},
+	}
+
+	for _, tt := range tests {
+		if err := checkMovement(account, tt.amount, tt.memo); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckLimit(t *testing.T) {
+	max := ron(2000000)
+
+	tests := []struct {
+		name    string
+		moved   Money
+		amount  Money
+		wantErr error
+	}{
+		{name: "first of the day", moved: ron(0), amount: ron(1000000)},
+		{name: "up to the limit", moved: ron(1500000), amount: ron(500000)},
+		{name: "one unit over", moved: ron(1500000), amount: ron(500001), wantErr: ErrLimitExceeded},
+		{name: "limit used up", moved: ron(2000000), amount: ron(1), wantErr: ErrLimitExceeded},
+		{name: "other currency", moved: ron(0), amount: Money{1, CurrencyEUR}, wantErr: ErrCurrencyMismatch},
+	}
+
+	for _, tt := range tests {
+		if err := checkLimit(tt.moved, tt.amount, max); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+// Deposits are taken by tellers only and, like withdrawals and transfers,
+// stop at the daily limit of the account.
+func TestAccountMovementLimits(t *testing.T) {
+	testDb(t)
+
+	account := testUser(t, "buyer1", ProfileTypeBuyer, CurrencyRON)
+	testUser(t, "buyer2", ProfileTypeBuyer, CurrencyRON)
+	buyer := Session{Username: "buyer1", Profile: ProfileTypeBuyer}
+	teller := Session{Username: "teller1", Profile: ProfileTypeManager}
+
+	steps := []struct {
+		name    string
+		move    func() (StatementLine, error)
+		wantErr error
+	}{
+		{"buyer deposits", func() (StatementLine, error) { return Deposit(buyer, "buyer1", ron(100000), "") }, ErrForbidden},
+		{"teller deposits", func() (StatementLine, error) { return Deposit(teller, "buyer1", ron(1000000), "") }, nil},
+		{"teller deposits again", func() (StatementLine, error) { return Deposit(teller, "buyer1", ron(1000000), "") }, nil},
+		{"past the daily deposits", func() (StatementLine, error) { return Deposit(teller, "buyer1", ron(1), "") }, ErrLimitExceeded},
+		{"other account's deposits", func() (StatementLine, error) { return Deposit(teller, "buyer2", ron(1000000), "") }, nil},
+		{"past the operation limit", func() (StatementLine, error) { return Withdraw(buyer, ron(1000001), "") }, ErrLimitExceeded},
+		{"withdraw", func() (StatementLine, error) { return Withdraw(buyer, ron(1500000), "") }, nil},
+		{"transfer", func() (StatementLine, error) { return Transfer(buyer, "buyer2", ron(500000), "") }, nil},
+		{"past the daily outgoing", func() (StatementLine, error) { return Transfer(buyer, "buyer2", ron(1), "") }, ErrLimitExceeded},
+		{"to oneself", func() (StatementLine, error) { return Transfer(buyer, "buyer1", ron(1), "") }, ErrSameAccount},
+	}
+
+	for _, step := range steps {
+		if _, err := step.move(); !errors.Is(err, step.wantErr) {
+			t.Fatalf("%s: error = %v, want %v", step.name, err, step.wantErr)
+		}
+	}
+
+	if got := testBalance(t, account); got != ron(0) {
+		t.Errorf("buyer1 balance %s, want 0.00", got)
+	}
+}
@@ -0,0 +1,30 @@
+package mongodb
+
+import (
+	"context"
+	"time"
+)
+
+// AuditEvent records a refused or sensitive action for later review.
+type AuditEvent struct {
+	At       time.Time `json:"at" bson:"at"`
+	Username string    `json:"username" bson:"username"`
+	Action   string    `json:"action" bson:"action"`
+	Receipt  MyId      `json:"receipt,omitempty" bson:"receipt,omitempty"`
+	Detail   string    `json:"detail" bson:"detail"`
+}
+
+func InsertAudit(event AuditEvent) error {
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Audit)
+
+	if event.At.IsZero() {
+		event.At = time.Now()
+	}
+
+	if _, err := collection.InsertOne(ctx, event); err != nil {
+		return err
+	}
+
+	return nil
+}
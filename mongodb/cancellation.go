@@ -0,0 +1,162 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"time"
+)
+
+func (r CancelReason) Valid() bool {
+	switch r {
+	case CancelReasonCustomerLeft, CancelReasonOperatorError, CancelReasonPriceDispute, CancelReasonOther:
+		return true
+	}
+	return false
+}
+
+// Expired reports whether an open receipt is past its expiry. Receipts created
+// before expiry existed never expire, and neither do partly paid ones.
+func (r Receipt) Expired(now time.Time) bool {
+	return !r.ExpiresAt.IsZero() && now.After(r.ExpiresAt) && len(r.Payments) == 0
+}
+
+// closeOpenReceipt moves an open receipt to status, releasing its stock. A
+// receipt with payments is only closed along with them, once they have been
+// given back, see reversePayments.
+func closeOpenReceipt(ctx context.Context, id MyId, status ReceiptStatus, reason CancelReason, username string, payments []Payment) error {
+	if _, err := ReleaseReservation(ctx, id); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	set := bson.M{
+		"status":        status,
+		"cancel_reason": reason,
+		"cancelled_by":  username,
+		"cancelled_at":  now,
+	}
+	// money taken for a receipt is never dropped with it
+	filter := bson.M{"id": id, "status": ReceiptStatusOpened, "payments": bson.M{"$exists": false}}
+	if len(payments) > 0 {
+		filter["payments"] = bson.M{"$size": len(payments)}
+		set["payments"] = payments
+	}
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Receipts)
+
+	result, err := collection.UpdateOne(ctx, filter, bson.M{"$set": set})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrReceiptNotOpen
+	}
+
+	return nil
+}
+
+// reversePayments gives back everything paid towards an open receipt: the
+// seller, or their till, is debited what was credited and every payment goes
+// back to its tender, as a refund would.
+func reversePayments(ctx context.Context, receipt *Receipt, username string, reason CancelReason) error {
+	entry := LedgerEntry{
+		Kind:      LedgerRefund,
+		Receipt:   receipt.Id,
+		Memo:      string(reason),
+		CreatedBy: username,
+	}
+
+	parts, err := splitRefund(receipt, receipt.Paid)
+	if err != nil {
+		return err
+	}
+	if err := takeBack(ctx, *receipt, parts, &entry); err != nil {
+		return err
+	}
+	if err := refundTenders(ctx, *receipt, parts, &entry); err != nil {
+		return err
+	}
+
+	return recordEntry(ctx, &entry)
+}
+
+// CancelReceipt abandons an open receipt. The seller who created it cancels
+// it; a manager can void the receipt of any seller. Only a manager can void a
+// partly paid receipt, and the payments are given back with it.
+func CancelReceipt(session Session, id int, reason CancelReason) (Receipt, error) {
+	if !reason.Valid() {
+		return Receipt{}, ErrInvalidReason
+	}
+
+	var receipt Receipt
+	err := RunTransaction(func(sessCtx mongo.SessionContext) error {
+		var err error
+		if receipt, err = getReceipt(sessCtx, id); err != nil {
+			return err
+		}
+		if receipt.Status != ReceiptStatusOpened {
+			return ErrReceiptNotOpen
+		}
+
+		status := ReceiptStatusCancelled
+		switch {
+		case session.Profile == ProfileTypeManager:
+			status = ReceiptStatusVoided
+		case session.Profile != ProfileTypeSeller || session.Username != receipt.Seller:
+			return ErrForbidden
+		}
+
+		if len(receipt.Payments) > 0 {
+			if status != ReceiptStatusVoided {
+				return ErrReceiptPartlyPaid
+			}
+			if err := reversePayments(sessCtx, &receipt, session.Username, reason); err != nil {
+				return err
+			}
+		}
+
+		return closeOpenReceipt(sessCtx, receipt.Id, status, reason, session.Username, receipt.Payments)
+	})
+	if err != nil {
+		return Receipt{}, err
+	}
+
+	return GetReceipt(id)
+}
+
+// ExpireReceipts cancels open receipts whose expiry has passed.
+func ExpireReceipts() error {
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Receipts)
+
+	filter := bson.M{
+		"status":     ReceiptStatusOpened,
+		"expires_at": bson.M{"$lt": time.Now()},
+		"payments":   bson.M{"$exists": false},
+	}
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	var expired []Receipt
+	if err := cursor.All(ctx, &expired); err != nil {
+		return err
+	}
+
+	for _, receipt := range expired {
+		err := RunTransaction(func(sessCtx mongo.SessionContext) error {
+			return closeOpenReceipt(sessCtx, receipt.Id, ReceiptStatusCancelled, CancelReasonExpired, "", nil)
+		})
+		// confirmed or cancelled in the meantime
+		if errors.Is(err, ErrReceiptNotOpen) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// A manager voids a partly paid receipt: the buyer's account and the voucher
+// get their payments back and the seller gives up what they were credited.
+func TestVoidPartlyPaidReceipt(t *testing.T) {
+	testDb(t)
+
+	sellerAccount := testUser(t, "seller1", ProfileTypeSeller, CurrencyRON)
+	buyerAccount := testUser(t, "buyer1", ProfileTypeBuyer, CurrencyRON)
+	testFund(t, sellerAccount, ron(3000))
+
+	manager := Session{Username: "manager1", Profile: ProfileTypeManager}
+	voucher, err := IssueVoucher(manager, Voucher{Code: "GIFT-0001", Amount: ron(2000)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := redeemVoucher(ctx, voucher.Code, ron(2000)); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	testInsert(t, MyDb.Receipts, Receipt{
+		Id:         1,
+		Seller:     "seller1",
+		Buyer:      "buyer1",
+		Status:     ReceiptStatusOpened,
+		CreatedAt:  now,
+		TotalPrice: ron(10000),
+		Paid:       ron(3000),
+		Payments: []Payment{
+			{Method: TenderAccount, Amount: ron(1000), Payer: "buyer1", At: now},
+			{Method: TenderVoucher, Amount: ron(2000), Reference: voucher.Code, Payer: "seller1", At: now},
+		},
+	})
+
+	seller := Session{Username: "seller1", Profile: ProfileTypeSeller}
+	if _, err := CancelReceipt(seller, 1, CancelReasonCustomerLeft); !errors.Is(err, ErrReceiptPartlyPaid) {
+		t.Fatalf("seller cancel error = %v, want %v", err, ErrReceiptPartlyPaid)
+	}
+
+	receipt, err := CancelReceipt(manager, 1, CancelReasonCustomerLeft)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Status != ReceiptStatusVoided {
+		t.Errorf("status = %v, want %v", receipt.Status, ReceiptStatusVoided)
+	}
+	for i, payment := range receipt.Payments {
+		if payment.Refunded != payment.Amount {
+			t.Errorf("payment %d refunded %s of %s", i, payment.Refunded, payment.Amount)
+		}
+	}
+	if got := testBalance(t, buyerAccount); got != ron(1000) {
+		t.Errorf("buyer balance %s, want 10.00", got)
+	}
+	if got := testBalance(t, sellerAccount); got != ron(0) {
+		t.Errorf("seller balance %s, want 0.00", got)
+	}
+	if err := redeemVoucher(ctx, voucher.Code, ron(2000)); err != nil {
+		t.Errorf("voucher not restored: %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"testing"
+	"time"
+)
+
+// testDb points the package at a fresh database on the server named by
+// BANKING_TEST_MONGODB, e.g. mongodb://localhost:27017/?replicaSet=rs0, and
+// drops it when the test ends. The server has to be a replica set since most
+// writes run in transactions. Without the variable the test is skipped.
+func testDb(t *testing.T) {
+	t.Helper()
+
+	url := os.Getenv("BANKING_TEST_MONGODB")
+	if url == "" {
+		t.Skip("BANKING_TEST_MONGODB is not set")
+	}
+
+	savedDb := MyDb
+	savedClient := Client
+	savedCost := PasswordCost
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(url))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Client = client
+	PasswordCost = bcrypt.MinCost
+	MyDb.Url = url
+	MyDb.DbName = fmt.Sprintf("banking_test_%d", time.Now().UnixNano())
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_ = Client.Database(MyDb.DbName).Drop(ctx)
+		_ = Client.Disconnect(ctx)
+		MyDb = savedDb
+		Client = savedClient
+		PasswordCost = savedCost
+	})
+
+	if err := EnsureIndexes(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// ron is amount in bani, the minor unit of the default currency.
+func ron(amount int64) Money {
+	return Money{amount, CurrencyRON}
+}
+
+// testError reports whether a table case ends in an error, failing the test
+// when it is not want.
+func testError(t *testing.T, name string, err error, want error) bool {
+	t.Helper()
+	if err == nil && want == nil {
+		return false
+	}
+	if !errors.Is(err, want) {
+		t.Errorf("%s: error = %v, want %v", name, err, want)
+	}
+	return true
+}
+
+// testUser registers a user and returns the id of their account.
+func testUser(t *testing.T, username string, profile ProfileType, currency Currency) string {
+	t.Helper()
+	user, err := RegisterUser(username, "password123", profile, currency)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user.Account.Id
+}
+
+// testFund adds amount to an account without a ledger entry.
+func testFund(t *testing.T, accountId string, amount Money) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := UpdateAccount(ctx, accountId, amount); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testBalance(t *testing.T, accountId string) Money {
+	t.Helper()
+	account, err := GetAccount(accountId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return account.Balance
+}
+
+func testInsert(t *testing.T, collection string, doc interface{}) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := Client.Database(MyDb.DbName).Collection(collection).InsertOne(ctx, doc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testMoneyInSystem adds up every account balance and what the ledger holds on
+// system accounts; money that is only moved around leaves it at zero.
+func testMoneyInSystem(t *testing.T) Money {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	db := Client.Database(MyDb.DbName)
+
+	var accounts []Account
+	cursor, err := db.Collection(MyDb.Accounts).Find(ctx, bson.M{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cursor.All(ctx, &accounts); err != nil {
+		t.Fatal(err)
+	}
+	var entries []LedgerEntry
+	if cursor, err = db.Collection(MyDb.Ledger).Find(ctx, bson.M{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cursor.All(ctx, &entries); err != nil {
+		t.Fatal(err)
+	}
+
+	total := ron(0)
+	for _, account := range accounts {
+		if total, err = total.Add(account.Balance); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, entry := range entries {
+		for _, posting := range entry.Postings {
+			if !IsSystemAccount(posting.Account) {
+				continue
+			}
+			if total, err = total.Add(posting.Amount); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return total
+}
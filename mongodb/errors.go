@@ -0,0 +1,78 @@
+package mongodb
+
+import "errors"
+
+var (
+	ErrReceiptNotOpen     = errors.New("receipt is not open")
+	ErrInsufficientFunds  = errors.New("insufficient funds")
+	ErrInsufficientStock  = errors.New("insufficient stock")
+	ErrInvalidQuantity    = errors.New("quantity must be positive")
+	ErrWeakPassword       = errors.New("password is too short")
+	ErrPasswordTooLong    = errors.New("password is longer than 72 bytes")
+	ErrForbidden          = errors.New("not allowed for this profile")
+	ErrInvalidUsername    = errors.New("username must be 3-32 letters, digits, '.', '_' or '-'")
+	ErrUsernameTaken      = errors.New("username is already taken")
+	ErrInvalidProfile     = errors.New("unknown profile")
+	ErrInvalidCurrency    = errors.New("invalid currency")
+	ErrPartyMismatch      = errors.New("payer or payee does not match the receipt")
+	ErrReceiptExpired     = errors.New("receipt has expired")
+	ErrInvalidReason      = errors.New("unknown cancel reason")
+	ErrReceiptNotClosed   = errors.New("receipt is not closed")
+	ErrRefundTooLarge     = errors.New("refund exceeds what was sold")
+	ErrLineNotFound       = errors.New("product is not on the receipt")
+	ErrInvalidPromotion   = errors.New("invalid promotion")
+	ErrInvalidCoupon      = errors.New("unknown or inactive coupon")
+	ErrCouponExhausted    = errors.New("coupon has reached its usage limit")
+	ErrInvalidTaxCategory = errors.New("unknown tax category")
+	ErrInvalidTaxRate     = errors.New("tax rate must be 0-10000 basis points")
+	ErrTaxCategoryChange  = errors.New("product already has another tax category")
+	ErrNoExchangeRate     = errors.New("no exchange rate between the currencies")
+	ErrInvalidRate        = errors.New("exchange rate must be a positive decimal")
+	ErrInvalidTender      = errors.New("unknown tender type")
+	ErrInvalidAmount      = errors.New("amount must be positive")
+	ErrOverpayment        = errors.New("payment exceeds what is due")
+	ErrReceiptPartlyPaid  = errors.New("receipt already has payments")
+	ErrInvalidVoucher     = errors.New("unknown or expired voucher")
+	ErrVoucherBalance     = errors.New("voucher balance is too low")
+	ErrReferenceUsed      = errors.New("tender reference was already used")
+	ErrUnbalancedEntry    = errors.New("ledger entry does not balance")
+	ErrLimitExceeded      = errors.New("amount is over the limit")
+	ErrInvalidMemo        = errors.New("memo is too long")
+	ErrSameAccount        = errors.New("cannot transfer to the same account")
+	ErrInvalidPeriod      = errors.New("from must be before to")
+	ErrInvalidPage        = errors.New("page is out of range")
+	ErrTillShort          = errors.New("till holds less than that")
+	ErrInvalidCreditLimit = errors.New("credit limit must not be negative")
+)
+
+type ConfirmStep string
+
+const (
+	ConfirmStepLookup   ConfirmStep = "lookup"
+	ConfirmStepExchange ConfirmStep = "exchange"
+	ConfirmStepDebit    ConfirmStep = "debit_buyer"
+	ConfirmStepCredit   ConfirmStep = "credit_seller"
+	ConfirmStepCoupons  ConfirmStep = "redeem_coupons"
+	ConfirmStepLedger   ConfirmStep = "record_ledger"
+	ConfirmStepStock    ConfirmStep = "update_stock"
+	ConfirmStepReceipt  ConfirmStep = "close_receipt"
+	ConfirmStepCommit   ConfirmStep = "commit"
+)
+
+// ConfirmError tells which step of a receipt confirmation failed: the lookup
+// and checks of the receipt and both accounts, the currency conversion, the
+// debit and credit, the ledger entry, the coupons, the stock and closing the
+// receipt, or the commit. All of them run in one transaction, so nothing from
+// a failed attempt was persisted.
+type ConfirmError struct {
+	Step ConfirmStep
+	Err  error
+}
+
+func (e *ConfirmError) Error() string {
+	return string(e.Step) + ": " + e.Err.Error()
+}
+
+func (e *ConfirmError) Unwrap() error {
+	return e.Err
+}
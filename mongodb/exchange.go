@@ -0,0 +1,181 @@
+package mongodb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// digits kept when a rate has to be inverted
+const inverseRateDigits = 10
+
+func parseRate(s string) (*big.Rat, error) {
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok || r.Sign() <= 0 {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidRate, s)
+	}
+	return r, nil
+}
+
+// Convert turns m into currency to at rate units of to per unit of m.
+func (m Money) Convert(to Currency, rate *big.Rat) (Money, error) {
+	return moneyFromRat(new(big.Rat).Mul(m.Rat(), rate), to)
+}
+
+func SetExchangeRate(rate ExchangeRate) error {
+	if !rate.From.Valid() || !rate.To.Valid() || rate.From == rate.To {
+		return ErrInvalidCurrency
+	}
+	if _, err := parseRate(rate.Rate); err != nil {
+		return err
+	}
+
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.ExchangeRates)
+
+	filter := bson.M{"from": rate.From, "to": rate.To}
+	update := bson.M{"$set": bson.M{"rate": strings.TrimSpace(rate.Rate), "updated_at": time.Now()}}
+
+	if _, err := collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// LoadExchangeRates sets every rate of a JSON file holding a list of
+// {"from": "EUR", "to": "RON", "rate": "4.9750"}.
+func LoadExchangeRates(path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var rates []ExchangeRate
+	if err = json.Unmarshal(data, &rates); err != nil {
+		return 0, err
+	}
+
+	for i, rate := range rates {
+		if err := SetExchangeRate(rate); err != nil {
+			return i, fmt.Errorf("%s to %s: %w", rate.From, rate.To, err)
+		}
+	}
+
+	return len(rates), nil
+}
+
+// exchangeRate finds the rate from one currency to another, using the rate of
+// the opposite direction inverted if that is the only one known.
+func exchangeRate(ctx context.Context, from Currency, to Currency) (string, error) {
+	from = from.orDefault()
+	to = to.orDefault()
+	if from == to {
+		return "1", nil
+	}
+
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.ExchangeRates)
+
+	var rate ExchangeRate
+	err := collection.FindOne(ctx, bson.M{"from": from, "to": to}).Decode(&rate)
+	if err == nil {
+		return rate.Rate, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return "", err
+	}
+
+	err = collection.FindOne(ctx, bson.M{"from": to, "to": from}).Decode(&rate)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return "", fmt.Errorf("%w: %s to %s", ErrNoExchangeRate, from, to)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	r, err := parseRate(rate.Rate)
+	if err != nil {
+		return "", err
+	}
+	inverse := new(big.Rat).Inv(r).FloatString(inverseRateDigits)
+	return strings.TrimRight(strings.TrimRight(inverse, "0"), "."), nil
+}
+
+// convert turns amount into currency to at the current rate, which it also
+// returns.
+func convert(ctx context.Context, amount Money, to Currency) (Money, string, error) {
+	rate, err := exchangeRate(ctx, amount.Currency, to)
+	if err != nil {
+		return Money{}, "", err
+	}
+	r, err := parseRate(rate)
+	if err != nil {
+		return Money{}, "", err
+	}
+	converted, err := amount.Convert(to.orDefault(), r)
+	if err != nil {
+		return Money{}, "", err
+	}
+	return converted, rate, nil
+}
+
+// Currency is the currency an account is kept in, the one of its balance.
+func (a Account) Currency() Currency {
+	return a.Balance.Currency.orDefault()
+}
+
+// convertForAccount is amount, a part of the receipt total, in the currency of
+// account. When the currencies differ the conversion is recorded on the
+// receipt, and later payments of the same account use the recorded rate.
+func convertForAccount(ctx context.Context, receipt *Receipt, account Account, amount Money) (Money, error) {
+	to := account.Currency()
+	if amount.Currency.orDefault() == to {
+		return amount, nil
+	}
+
+	for i, conversion := range receipt.Conversions {
+		if conversion.Account != account.Id {
+			continue
+		}
+		converted, err := receipt.recordedAmount(account.Id, amount)
+		if err != nil {
+			return Money{}, err
+		}
+		if receipt.Conversions[i].Amount, err = conversion.Amount.Add(converted); err != nil {
+			return Money{}, err
+		}
+		return converted, nil
+	}
+
+	converted, rate, err := convert(ctx, amount, to)
+	if err != nil {
+		return Money{}, err
+	}
+
+	receipt.Conversions = append(receipt.Conversions, Conversion{Account: account.Id, Rate: rate, Amount: converted})
+	return converted, nil
+}
+
+// recordedAmount converts part of the receipt total for an account at the rate
+// it was confirmed with; accounts without a conversion get amount unchanged.
+func (r Receipt) recordedAmount(accountId string, amount Money) (Money, error) {
+	for _, conversion := range r.Conversions {
+		if conversion.Account != accountId {
+			continue
+		}
+		rate, err := parseRate(conversion.Rate)
+		if err != nil {
+			return Money{}, err
+		}
+		return amount.Convert(conversion.Amount.Currency, rate)
+	}
+	return amount, nil
+}
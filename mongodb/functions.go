@@ -5,35 +5,59 @@ import (
 	"errors"
 	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
 	"log"
-	"os/exec"
 	"time"
 )
 
 var Client *mongo.Client
 
+// printed in front of receipt numbers to tell stores apart, empty for none
+var ReceiptPrefix = ""
+
 type MongoDb struct {
-	Url         string
-	DbName      string
-	Users       string
-	Products    string
-	Receipts    string
-	Sessions    string
-	IdGenerator string
-	Accounts    string
+	Url           string
+	DbName        string
+	Users         string
+	Products      string
+	Receipts      string
+	Sessions      string
+	IdGenerator   string
+	Accounts      string
+	Idempotency   string
+	Reservations  string
+	Audit         string
+	Refunds       string
+	Promotions    string
+	TaxRates      string
+	ExchangeRates string
+	Ledger        string
+	Vouchers      string
+	TenderRefs    string
 }
 
 var MyDb = MongoDb{
-	Url:         "mongodb://localhost:27017",
-	DbName:      "banking",
-	Users:       "users",
-	Products:    "products",
-	Receipts:    "receipts",
-	Sessions:    "sessions",
-	IdGenerator: "id_generator",
-	Accounts:    "accounts",
+	Url:           "mongodb://localhost:27017",
+	DbName:        "banking",
+	Users:         "users",
+	Products:      "products",
+	Receipts:      "receipts",
+	Sessions:      "sessions",
+	IdGenerator:   "id_generator",
+	Accounts:      "accounts",
+	Idempotency:   "idempotency_keys",
+	Reservations:  "reservations",
+	Audit:         "audit",
+	Refunds:       "refunds",
+	Promotions:    "promotions",
+	TaxRates:      "tax_rates",
+	ExchangeRates: "exchange_rates",
+	Ledger:        "ledger",
+	Vouchers:      "vouchers",
+	TenderRefs:    "tender_references",
 }
 
 func Init() {
@@ -45,10 +69,187 @@ func Init() {
 		log.Fatal(err)
 	}
 	fmt.Println("Connected to mongodb was successful")
+
+	if err := EnsureIndexes(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func EnsureIndexes() error {
+	ctx, _ := context.WithTimeout(context.Background(), 30*time.Second)
+	db := Client.Database(MyDb.DbName)
+
+	idempotency := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "key", Value: 1}, {Key: "route", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "created_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(IdempotencyKeyTTL.Seconds())),
+		},
+	}
+	if _, err := db.Collection(MyDb.Idempotency).Indexes().CreateMany(ctx, idempotency); err != nil {
+		return err
+	}
+
+	unique := options.Index().SetUnique(true)
+	if _, err := db.Collection(MyDb.Users).Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "username", Value: 1}}, Options: unique}); err != nil {
+		return err
+	}
+	if _, err := db.Collection(MyDb.Accounts).Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "id", Value: 1}}, Options: unique}); err != nil {
+		return err
+	}
+
+	// mongodb removes sessions once expires_at has passed. Sessions from before
+	// token hashing have no token_hash until "banking migrate" removes them, so
+	// the unique index leaves them out.
+	sessions := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "token_hash", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"token_hash": bson.M{"$exists": true}}),
+		},
+		{
+			Keys: bson.D{{Key: "username", Value: 1}},
+		},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	}
+	if err := dropFullTokenIndex(ctx, db.Collection(MyDb.Sessions)); err != nil {
+		return err
+	}
+	if _, err := db.Collection(MyDb.Sessions).Indexes().CreateMany(ctx, sessions); err != nil {
+		return err
+	}
+
+	if _, err := db.Collection(MyDb.IdGenerator).Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "name", Value: 1}}, Options: unique}); err != nil {
+		return err
+	}
+
+	if _, err := db.Collection(MyDb.Products).Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "id", Value: 1}}, Options: unique}); err != nil {
+		return err
+	}
+
+	receipts := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: unique},
+		{Keys: bson.D{{Key: "seller", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "buyer", Value: 1}, {Key: "confirmed_at", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "expires_at", Value: 1}}},
+	}
+	if _, err := db.Collection(MyDb.Receipts).Indexes().CreateMany(ctx, receipts); err != nil {
+		return err
+	}
+
+	refunds := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: unique},
+		{Keys: bson.D{{Key: "receipt", Value: 1}}},
+	}
+	if _, err := db.Collection(MyDb.Refunds).Indexes().CreateMany(ctx, refunds); err != nil {
+		return err
+	}
+
+	reservations := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "receipt", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "expires_at", Value: 1}},
+		},
+	}
+	if _, err := db.Collection(MyDb.Reservations).Indexes().CreateMany(ctx, reservations); err != nil {
+		return err
+	}
+
+	promotions := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: unique},
+		{Keys: bson.D{{Key: "coupon", Value: 1}}},
+	}
+	if _, err := db.Collection(MyDb.Promotions).Indexes().CreateMany(ctx, promotions); err != nil {
+		return err
+	}
+
+	if _, err := db.Collection(MyDb.TaxRates).Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "category", Value: 1}}, Options: unique}); err != nil {
+		return err
+	}
+
+	if _, err := db.Collection(MyDb.ExchangeRates).Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "from", Value: 1}, {Key: "to", Value: 1}}, Options: unique}); err != nil {
+		return err
+	}
+
+	if _, err := db.Collection(MyDb.Vouchers).Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "code", Value: 1}}, Options: unique}); err != nil {
+		return err
+	}
+
+	// a card authorization pays for one receipt only
+	if _, err := db.Collection(MyDb.TenderRefs).Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "method", Value: 1}, {Key: "reference", Value: 1}}, Options: unique}); err != nil {
+		return err
+	}
+
+	ledger := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: unique},
+		{Keys: bson.D{{Key: "postings.account", Value: 1}, {Key: "created_at", Value: 1}}},
+		{Keys: bson.D{{Key: "receipt", Value: 1}}},
+	}
+	if _, err := db.Collection(MyDb.Ledger).Indexes().CreateMany(ctx, ledger); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// dropFullTokenIndex removes a token_hash index built before it was partial,
+// which would otherwise conflict with the partial one.
+func dropFullTokenIndex(ctx context.Context, collection *mongo.Collection) error {
+	cursor, err := collection.Indexes().List(ctx)
+	if err != nil {
+		return err
+	}
+
+	var indexes []bson.M
+	if err = cursor.All(ctx, &indexes); err != nil {
+		return err
+	}
+
+	for _, index := range indexes {
+		if index["name"] != "token_hash_1" {
+			continue
+		}
+		if _, partial := index["partialFilterExpression"]; partial {
+			return nil
+		}
+		_, err := collection.Indexes().DropOne(ctx, "token_hash_1")
+		return err
+	}
+
+	return nil
+}
+
+// RunTransaction runs fn in a session transaction, retrying it on transient
+// errors. All writes made through the session context commit or abort together.
+func RunTransaction(fn func(sessCtx mongo.SessionContext) error) error {
+	session, err := Client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.Background())
+
+	ctx, _ := context.WithTimeout(context.Background(), 30*time.Second)
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sessCtx)
+	})
+
+	return err
 }
 
 func GetAccount(id string) (Account, error) {
 	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	return getAccount(ctx, id)
+}
+
+func getAccount(ctx context.Context, id string) (Account, error) {
 	collection := Client.Database(MyDb.DbName).Collection(MyDb.Accounts)
 
 	var account Account
@@ -61,6 +262,10 @@ func GetAccount(id string) (Account, error) {
 
 func GetUser(username string) (User, error) {
 	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	return getUser(ctx, username)
+}
+
+func getUser(ctx context.Context, username string) (User, error) {
 	collection := Client.Database(MyDb.DbName).Collection(MyDb.Users)
 
 	var user User
@@ -71,20 +276,36 @@ func GetUser(username string) (User, error) {
 	return user, nil
 }
 
+// GetSession returns a live session and pushes its expiry forward by
+// SessionTTL. Expired and logged out tokens are not found.
 func GetSession(token string) (Session, error) {
 	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
 	collection := Client.Database(MyDb.DbName).Collection(MyDb.Sessions)
 
+	now := time.Now()
+	filter := bson.M{
+		"token_hash": hashToken(token),
+		"expires_at": bson.M{"$gt": now},
+		"issued_at":  bson.M{"$gt": now.Add(-SessionMaxAge)},
+	}
+	update := bson.M{"$set": bson.M{"expires_at": now.Add(SessionTTL)}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
 	var session Session
-	if err := collection.FindOne(ctx, bson.M{"token": token}).Decode(&session); err != nil {
+	if err := collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&session); err != nil {
 		return Session{}, err
 	}
+	session.Token = token
 
 	return session, nil
 }
 
 func GetProduct(id string) (Product, error) {
 	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	return getProduct(ctx, id)
+}
+
+func getProduct(ctx context.Context, id string) (Product, error) {
 	collection := Client.Database(MyDb.DbName).Collection(MyDb.Products)
 
 	var product Product
@@ -95,11 +316,27 @@ func GetProduct(id string) (Product, error) {
 	return product, nil
 }
 
+// VisibleTo reports whether session may see the receipt: its seller, its
+// buyer, admins and managers.
+func (r Receipt) VisibleTo(session Session) bool {
+	switch {
+	case session.Profile == ProfileTypeAdmin, session.Profile == ProfileTypeManager:
+		return true
+	case session.Username == "":
+		return false
+	}
+	return session.Username == r.Seller || session.Username == r.Buyer
+}
+
 func GetReceipt(id int) (Receipt, error) {
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	return getReceipt(ctx, id)
+}
+
+func getReceipt(ctx context.Context, id int) (Receipt, error) {
 	var receipt Receipt
 	var err error
 
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
 	collection := Client.Database(MyDb.DbName).Collection(MyDb.Receipts)
 
 	if err = collection.FindOne(ctx, bson.M{"id": id}).Decode(&receipt); err != nil {
@@ -143,28 +380,40 @@ func InsertSession(session Session) error {
 	return nil
 }
 
-func Login(username string, password string, profile ProfileType) (Session, error) {
+// Login opens a session with the profile stored for the user.
+func Login(username string, password string) (Session, error) {
 	var session Session
 	var user User
 
 	var err error
 	if user, err = GetUser(username); err != nil {
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
 		return session, err
 	}
 
-	if user.Password != password {
+	ok, rehash := verifyPassword(user.Password, password)
+	if !ok {
 		return session, errors.New("invalid password")
 	}
+	if rehash {
+		if err := rehashPassword(username, password); err != nil {
+			fmt.Println(err)
+		}
+	}
 
-	token, err := exec.Command("uuidgen").Output()
+	token, err := NewToken()
 	if err != nil {
 		return session, err
 	}
 
+	now := time.Now()
 	session = Session{
-		Token:    string(token[0 : len(token)-2]),
-		Username: username,
-		Profile:  profile,
+		Token:     token,
+		TokenHash: hashToken(token),
+		Username:  username,
+		Profile:   user.Profile,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(SessionTTL),
 	}
 
 	if err := InsertSession(session); err != nil {
@@ -174,85 +423,101 @@ func Login(username string, password string, profile ProfileType) (Session, erro
 	return session, nil
 }
 
-func AddProduct(token string, stock ProductStock) error {
+// AddProduct adds a stock lot, creating the product on its first lot in
+// category, standard if empty. Restocking an existing product with a different
+// category fails with ErrTaxCategoryChange; SetProductTaxCategory changes it.
+func AddProduct(token string, stock ProductStock, category TaxCategory) error {
 	if _, err := GetSession(token); err != nil {
 		return err
 	}
 
-	var product Product
-	var err error
-
-	if product, err = GetProduct(stock.Id); err != nil {
-		// product does not exist
-
-		var newProduct Product
-		newProduct.Id = stock.Id
-		newProduct.Name = stock.Name
-		newProduct.Price = stock.Price
-		newProduct.TotalAvailable = stock.TotalAvailable
-		newProduct.TotalSold = 0
-		newProduct.Stocks = append(newProduct.Stocks, stock)
-
-		if err := InsertProduct(newProduct); err != nil {
-			return err
-		}
-		return nil
+	if !stock.Price.Currency.orDefault().Valid() {
+		return ErrInvalidCurrency
+	}
+	if _, err := GetTaxRate(category); err != nil {
+		return err
 	}
 
-	product.TotalAvailable += stock.TotalAvailable
-	product.Stocks = append(product.Stocks, stock)
-
-	filter := bson.M{"id": product.Id}
-	update := bson.M{"$set": product}
+	// a single upsert, so concurrent restocks of the same product all count.
+	// With a category given the filter misses a product having another one,
+	// and the upsert then collides with it on the unique id.
+	filter := bson.M{"id": stock.Id}
+	if category != "" {
+		filter["tax_category"] = category
+	}
+	category = category.orDefault()
+	update := bson.M{
+		"$setOnInsert": bson.M{
+			"name":           stock.Name,
+			"price":          stock.Price,
+			"tax_category":   category,
+			"total_reserved": float32(0),
+			"total_sold":     float32(0),
+		},
+		"$inc":  bson.M{"total_available": stock.TotalAvailable},
+		"$push": bson.M{"stocks": stock},
+	}
 	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
 	collection := Client.Database(MyDb.DbName).Collection(MyDb.Products)
 
-	if _, err := collection.UpdateOne(ctx, filter, update); err != nil {
+	if _, err := collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true)); err != nil {
 		fmt.Println(err)
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("%w: %s", ErrTaxCategoryChange, stock.Id)
+		}
 		return err
 	}
 
 	return nil
 }
 
-func GenerateId() (MyId, error) {
+// GenerateId hands out the next number of a sequence in a single atomic
+// update, creating the sequence at 1 the first time it is used.
+func GenerateId(name Sequence) (MyId, error) {
 	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	return generateId(ctx, name)
+}
+
+func generateId(ctx context.Context, name Sequence) (MyId, error) {
 	collection := Client.Database(MyDb.DbName).Collection(MyDb.IdGenerator)
 
-	var id IdGenerator
-	if err := collection.FindOne(ctx, bson.M{}).Decode(&id); err != nil {
-		return -1, err
-	}
+	filter := bson.M{"name": name}
+	update := bson.M{"$inc": bson.M{"id": 1}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
 
-	ctx, _ = context.WithTimeout(context.Background(), 10*time.Second)
-	if _, err := collection.UpdateOne(ctx, bson.M{}, bson.M{"$set": bson.M{"id": id.Id + 1}}); err != nil {
+	var id IdGenerator
+	if err := collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&id); err != nil {
 		return -1, err
 	}
 
 	return id.Id, nil
 }
 
-func UpdateStock(id string, quantity float32) error {
-	var product Product
-	var err error
-	if product, err = GetProduct(id); err != nil {
-		return err
+// FormatNumber builds the printed receipt number, e.g. "B01-00000042".
+func FormatNumber(prefix string, id MyId) string {
+	if prefix == "" {
+		return fmt.Sprintf("%08d", id)
 	}
+	return fmt.Sprintf("%s-%08d", prefix, id)
+}
 
-	product.TotalAvailable -= quantity
-	product.TotalSold += quantity
-
+// allocateLots takes quantity from the oldest lots first. It returns the lots
+// as they are after the sale and what was taken from each.
+func allocateLots(stocks []ProductStock, quantity float32) ([]ProductStock, []LotAllocation) {
+	remaining := quantity
+	var lots []LotAllocation
 	var newStocks []ProductStock
-	for _, stock := range product.Stocks {
+	for lot, stock := range stocks {
 		newStock := stock
-		if quantity > newStock.TotalAvailable {
-			quantity -= newStock.TotalAvailable
-			newStock.TotalSold += newStock.TotalAvailable
-			newStock.TotalAvailable = 0
-		} else {
-			newStock.TotalAvailable -= quantity
-			newStock.TotalSold += quantity
-			quantity = 0
+		taken := remaining
+		if remaining > newStock.TotalAvailable {
+			taken = newStock.TotalAvailable
+		}
+		remaining -= taken
+		newStock.TotalAvailable -= taken
+		newStock.TotalSold += taken
+		if taken > 0 {
+			lots = append(lots, LotAllocation{Lot: lot, Quantity: taken})
 		}
 
 		if newStock.TotalAvailable == 0 {
@@ -262,140 +527,325 @@ func UpdateStock(id string, quantity float32) error {
 		newStocks = append(newStocks, newStock)
 	}
 
-	product.Stocks = newStocks
-	filter := bson.M{"id": id}
-	update := bson.M{"$set": product}
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	return newStocks, lots
+}
+
+// UpdateStock sells quantity from the oldest lots first and returns what was
+// taken from each lot. Products carry no version to compare: UpdateStock runs
+// inside the confirming transaction, where a concurrent sale of the same
+// product makes one of them fail with a write conflict, and RunTransaction
+// retries that one against the new stock.
+func UpdateStock(ctx context.Context, id string, quantity float32) ([]LotAllocation, error) {
 	collection := Client.Database(MyDb.DbName).Collection(MyDb.Products)
 
-	if _, err := collection.UpdateOne(ctx, filter, update); err != nil {
-		return err
+	product, err := getProduct(ctx, id)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	// stock held by other open receipts is not for sale
+	if product.TotalAvailable-product.TotalReserved < quantity {
+		return nil, fmt.Errorf("%w: product %s", ErrInsufficientStock, id)
+	}
+
+	newStocks, lots := allocateLots(product.Stocks, quantity)
+
+	update := bson.M{
+		"$set": bson.M{"stocks": newStocks},
+		"$inc": bson.M{"total_available": -quantity, "total_sold": quantity},
+	}
+	if _, err := collection.UpdateOne(ctx, bson.M{"id": id}, update); err != nil {
+		return nil, err
+	}
+
+	return lots, nil
 }
 
-func CalculateTotalPrice(products []ReceiptProduct) (float32, error) {
-	var total float32
-	var err error
+// SnapshotProducts copies name, current price, tax category and rate of every
+// line from the catalogue, so the receipt no longer depends on later price or
+// rate changes.
+func SnapshotProducts(products []ReceiptProduct) ([]ReceiptProduct, error) {
+	var lines []ReceiptProduct
+	now := time.Now()
+
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	rates, err := GetTaxRates(ctx)
+	if err != nil {
+		return nil, err
+	}
 
 	for _, product := range products {
 		var mock Product
-		var err error
 		if mock, err = GetProduct(product.Id); err != nil {
-			return -1, err
+			return nil, err
+		}
+
+		line := ReceiptProduct{
+			Id:          product.Id,
+			Quantity:    product.Quantity,
+			Name:        mock.Name,
+			UnitPrice:   mock.PriceAt(now),
+			TaxCategory: mock.TaxCategory.orDefault(),
+		}
+		var ok bool
+		if line.TaxRate, ok = rates[line.TaxCategory]; !ok {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidTaxCategory, line.TaxCategory)
+		}
+		if line.LineTotal, err = line.UnitPrice.MulQuantity(product.Quantity); err != nil {
+			return nil, err
 		}
 
-		price := mock.Price
-		quantity := product.Quantity
-		total += price * quantity
+		lines = append(lines, line)
+	}
+
+	return lines, nil
+}
+
+func CalculateTotalPrice(products []ReceiptProduct) (Money, error) {
+	var total Money
+	var err error
+
+	for _, product := range products {
+		if total, err = total.Add(product.LineTotal); err != nil {
+			return Money{}, err
+		}
 	}
 
 	return total, err
 }
 
-func CreateReceipt(token string, recProducts []ReceiptProduct) (Receipt, error) {
-	if _, err := GetSession(token); err != nil {
+// CreateReceipt opens a receipt for the seller owning token. terminal is an
+// optional till or device id, coupons the codes the customer handed in.
+func CreateReceipt(token string, recProducts []ReceiptProduct, terminal string, coupons []string) (Receipt, error) {
+	var session Session
+	var err error
+	if session, err = GetSession(token); err != nil {
 		return Receipt{}, err
 	}
 
+	for _, product := range recProducts {
+		if product.Quantity <= 0 {
+			return Receipt{}, ErrInvalidQuantity
+		}
+	}
+
 	var receipt Receipt
-	var err error
-	var id MyId
-	if id, err = GenerateId(); err != nil {
+	receipt.Seller = session.Username
+	receipt.Terminal = terminal
+	receipt.CreatedAt = time.Now()
+	receipt.ExpiresAt = receipt.CreatedAt.Add(ReservationTTL)
+	if receipt.Products, err = SnapshotProducts(mergeProducts(recProducts)); err != nil {
 		return Receipt{}, err
 	}
-
-	receipt.Id = id
-	receipt.Products = recProducts
-	if receipt.TotalPrice, err = CalculateTotalPrice(recProducts); err != nil {
+	receipt.Coupons = normalizeCoupons(coupons)
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	if err = PriceReceipt(ctx, &receipt, receipt.CreatedAt); err != nil {
 		return Receipt{}, err
 	}
 
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-	collection := Client.Database(MyDb.DbName).Collection(MyDb.Receipts)
+	// the receipt is only stored, and its number used up, if all of its stock
+	// could be held
+	err = RunTransaction(func(sessCtx mongo.SessionContext) error {
+		id, err := generateId(sessCtx, SequenceReceipts)
+		if err != nil {
+			return err
+		}
+		receipt.Id = id
+		receipt.Number = ""
+		if ReceiptPrefix != "" {
+			receipt.Number = FormatNumber(ReceiptPrefix, id)
+		}
 
-	if _, err := collection.InsertOne(ctx, receipt); err != nil {
+		if err := ReserveStock(sessCtx, receipt); err != nil {
+			return err
+		}
+
+		collection := Client.Database(MyDb.DbName).Collection(MyDb.Receipts)
+		if _, err := collection.InsertOne(sessCtx, receipt); err != nil {
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
 		return Receipt{}, err
 	}
 
 	return receipt, nil
 }
 
-func UpdateReceipt(receipt Receipt) error {
-	for _, product := range receipt.Products {
-		if err := UpdateStock(product.Id, product.Quantity); err != nil {
-			return err
-		}
+func UpdateReceipt(ctx context.Context, receipt Receipt) error {
+	// the held quantities become real sales below
+	if _, err := ReleaseReservation(ctx, receipt.Id); err != nil {
+		return &ConfirmError{Step: ConfirmStepStock, Err: err}
 	}
 
-	receipt.Status = ReceiptStatusClosed
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	for i, product := range receipt.Products {
+		lots, err := UpdateStock(ctx, product.Id, product.Quantity)
+		if err != nil {
+			return &ConfirmError{Step: ConfirmStepStock, Err: err}
+		}
+		receipt.Products[i].Lots = lots
+	}
+
+	// only an opened receipt can be closed, so a replayed confirmation matches nothing
+	filter := bson.M{"id": receipt.Id, "status": ReceiptStatusOpened}
+	update := bson.M{"$set": bson.M{
+		"status":       ReceiptStatusClosed,
+		"buyer":        receipt.Buyer,
+		"confirmed_at": receipt.ConfirmedAt,
+		"products":     receipt.Products,
+		"payments":     receipt.Payments,
+		"paid":         receipt.Paid,
+		"conversions":  receipt.Conversions,
+	}}
 	collection := Client.Database(MyDb.DbName).Collection(MyDb.Receipts)
 
-	if _, err := collection.UpdateOne(ctx, bson.M{"id": receipt.Id}, bson.M{"$set": receipt}); err != nil {
-		return err
+	if result, err := collection.UpdateOne(ctx, filter, update); err != nil {
+		return &ConfirmError{Step: ConfirmStepReceipt, Err: err}
+	} else if result.MatchedCount == 0 {
+		return &ConfirmError{Step: ConfirmStepReceipt, Err: ErrReceiptNotOpen}
 	}
 
 	return nil
 }
 
-func UpdateAccount(id string, balance float32) error {
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+// UpdateAccount adds a signed amount to the balance. A debit only applies while
+// balance + credit_limit still covers it; otherwise ErrInsufficientFunds is
+// returned and the balance is left untouched.
+func UpdateAccount(ctx context.Context, id string, balance Money) error {
 	collection := Client.Database(MyDb.DbName).Collection(MyDb.Accounts)
 
 	var account Account
 	var err error
-	if account, err = GetAccount(id); err != nil {
+	if account, err = getAccount(ctx, id); err != nil {
+		return err
+	}
+	if _, err = account.Balance.unify(balance); err != nil {
+		return err
+	}
+
+	var delta primitive.Decimal128
+	if delta, err = balance.Decimal128(); err != nil {
 		return err
 	}
 
-	account.Balance += balance
 	filter := bson.M{"id": id}
-	update := bson.M{"$set": account}
+	update := bson.M{"$inc": bson.M{"balance.amount": delta}}
 
-	if _, err = collection.UpdateOne(ctx, filter, update); err != nil {
+	if balance.IsNegative() {
+		var amount primitive.Decimal128
+		if amount, err = balance.Neg().Decimal128(); err != nil {
+			return err
+		}
+		available := bson.M{"$add": bson.A{"$balance.amount", bson.M{"$ifNull": bson.A{"$credit_limit.amount", 0}}}}
+		filter["$expr"] = bson.M{"$gte": bson.A{available, amount}}
+	}
+
+	var result *mongo.UpdateResult
+	if result, err = collection.UpdateOne(ctx, filter, update); err != nil {
 		return err
 	}
+	if result.MatchedCount == 0 {
+		return ErrInsufficientFunds
+	}
 
 	return nil
 }
 
-func ConfirmReceipt(usernameFrom string, usernameTo string, id int) error {
-	var userFrom User
-	var userTo User
-	var accountFrom Account
-	var accountTo Account
-	var receipt Receipt
-	var err error
+// ConfirmReceipt pays a receipt from the buyer's account into the account of
+// the seller who created it. When seller is not empty it must name that seller.
+func ConfirmReceipt(buyer string, seller string, id int) error {
+	// balances, stock and receipt status are committed or rolled back together
+	err := RunTransaction(func(sessCtx mongo.SessionContext) error {
+		var userFrom User
+		var userTo User
+		var accountFrom Account
+		var accountTo Account
+		var receipt Receipt
+		var err error
 
-	if userFrom, err = GetUser(usernameFrom); err != nil {
-		return err
-	}
-	if userTo, err = GetUser(usernameTo); err != nil {
-		return err
-	}
-	if accountFrom, err = GetAccount(userFrom.AccountId); err != nil {
-		return err
-	}
-	if accountTo, err = GetAccount(userTo.AccountId); err != nil {
-		return err
-	}
-	if receipt, err = GetReceipt(id); err != nil {
-		return err
-	}
+		if receipt, err = getReceipt(sessCtx, id); err != nil {
+			return &ConfirmError{Step: ConfirmStepLookup, Err: err}
+		}
+		if receipt.Status != ReceiptStatusOpened {
+			return &ConfirmError{Step: ConfirmStepLookup, Err: ErrReceiptNotOpen}
+		}
+		if receipt.Expired(time.Now()) {
+			return &ConfirmError{Step: ConfirmStepLookup, Err: ErrReceiptExpired}
+		}
+		// a split payment is finished through PayReceipt
+		if len(receipt.Payments) > 0 {
+			return &ConfirmError{Step: ConfirmStepLookup, Err: ErrReceiptPartlyPaid}
+		}
+		if receipt.Seller == "" {
+			return &ConfirmError{Step: ConfirmStepLookup, Err: fmt.Errorf("%w: receipt has no seller", ErrPartyMismatch)}
+		}
+		if seller != "" && seller != receipt.Seller {
+			return &ConfirmError{Step: ConfirmStepLookup, Err: fmt.Errorf("%w: receipt belongs to %s", ErrPartyMismatch, receipt.Seller)}
+		}
 
-	// updating balances
-	if err := UpdateAccount(accountFrom.Id, -receipt.TotalPrice); err != nil {
-		return err
-	}
-	if err := UpdateAccount(accountTo.Id, receipt.TotalPrice); err != nil {
-		return err
-	}
+		if userFrom, err = getUser(sessCtx, buyer); err != nil {
+			return &ConfirmError{Step: ConfirmStepLookup, Err: err}
+		}
+		if userTo, err = getUser(sessCtx, receipt.Seller); err != nil {
+			return &ConfirmError{Step: ConfirmStepLookup, Err: err}
+		}
+		if accountFrom, err = getAccount(sessCtx, userFrom.AccountId); err != nil {
+			return &ConfirmError{Step: ConfirmStepLookup, Err: err}
+		}
+		if accountTo, err = getAccount(sessCtx, userTo.AccountId); err != nil {
+			return &ConfirmError{Step: ConfirmStepLookup, Err: err}
+		}
 
-	// updating products
-	if err := UpdateReceipt(receipt); err != nil {
-		return err
+		// each side pays or is paid in the currency of its account
+		var debit Money
+		var credit Money
+		if debit, err = convertForAccount(sessCtx, &receipt, accountFrom, receipt.TotalPrice); err != nil {
+			return &ConfirmError{Step: ConfirmStepExchange, Err: err}
+		}
+		if credit, err = convertForAccount(sessCtx, &receipt, accountTo, receipt.TotalPrice); err != nil {
+			return &ConfirmError{Step: ConfirmStepExchange, Err: err}
+		}
+
+		// updating balances
+		if err := UpdateAccount(sessCtx, accountFrom.Id, debit.Neg()); err != nil {
+			return &ConfirmError{Step: ConfirmStepDebit, Err: err}
+		}
+		if err := UpdateAccount(sessCtx, accountTo.Id, credit); err != nil {
+			return &ConfirmError{Step: ConfirmStepCredit, Err: err}
+		}
+		entry := LedgerEntry{
+			Kind:      LedgerSale,
+			Receipt:   receipt.Id,
+			CreatedBy: buyer,
+			Postings: []Posting{
+				{Account: accountFrom.Id, Amount: debit.Neg()},
+				{Account: accountTo.Id, Amount: credit},
+			},
+		}
+		if err := recordEntry(sessCtx, &entry); err != nil {
+			return &ConfirmError{Step: ConfirmStepLedger, Err: err}
+		}
+		if err := redeemCoupons(sessCtx, receipt); err != nil {
+			return &ConfirmError{Step: ConfirmStepCoupons, Err: err}
+		}
+
+		// updating products
+		now := time.Now()
+		receipt.Buyer = buyer
+		receipt.ConfirmedAt = &now
+		receipt.Payments = []Payment{{Method: TenderAccount, Amount: receipt.TotalPrice, Payer: buyer, At: now}}
+		receipt.Paid = receipt.TotalPrice
+		return UpdateReceipt(sessCtx, receipt)
+	})
+
+	if err != nil {
+		var confirmErr *ConfirmError
+		if errors.As(err, &confirmErr) {
+			return err
+		}
+		return &ConfirmError{Step: ConfirmStepCommit, Err: err}
 	}
 
 	return nil
@@ -0,0 +1,29 @@
+package mongodb
+
+import "testing"
+
+func TestReceiptVisibleTo(t *testing.T) {
+	receipt := Receipt{Seller: "seller1", Buyer: "buyer1"}
+	tests := []struct {
+		name    string
+		session Session
+		want    bool
+	}{
+		{"seller", Session{Username: "seller1", Profile: ProfileTypeSeller}, true},
+		{"buyer", Session{Username: "buyer1", Profile: ProfileTypeBuyer}, true},
+		{"manager", Session{Username: "manager1", Profile: ProfileTypeManager}, true},
+		{"admin", Session{Username: "admin1", Profile: ProfileTypeAdmin}, true},
+		{"other seller", Session{Username: "seller2", Profile: ProfileTypeSeller}, false},
+		{"other buyer", Session{Username: "buyer2", Profile: ProfileTypeBuyer}, false},
+	}
+	for _, tt := range tests {
+		if got := receipt.VisibleTo(tt.session); got != tt.want {
+			t.Errorf("%s: VisibleTo = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// nobody is the buyer of a receipt that has none yet
+	if (Receipt{Seller: "seller1"}).VisibleTo(Session{Profile: ProfileTypeBuyer}) {
+		t.Errorf("receipt without a buyer visible to a session without a username")
+	}
+}
@@ -0,0 +1,93 @@
+package mongodb
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"time"
+)
+
+var IdempotencyKeyTTL = 24 * time.Hour
+
+// how long a claimed key waits for its response before a retry may take it
+// over, in case the process died while handling the first attempt
+var IdempotencyClaimTimeout = 2 * time.Minute
+
+type IdempotencyRecord struct {
+	Key       string    `bson:"key"`
+	Route     string    `bson:"route"`
+	BodyHash  string    `bson:"body_hash"`
+	Done      bool      `bson:"done"`
+	Code      int       `bson:"code"`
+	Body      []byte    `bson:"body"`
+	CreatedAt time.Time `bson:"created_at"`
+}
+
+// ReserveIdempotencyKey claims key for route. When the key was already claimed
+// the stored record is returned with reserved set to false, unless the claim
+// was never completed and is older than IdempotencyClaimTimeout; then it is
+// taken over.
+func ReserveIdempotencyKey(key string, route string, bodyHash string) (IdempotencyRecord, bool, error) {
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Idempotency)
+
+	record := IdempotencyRecord{
+		Key:       key,
+		Route:     route,
+		BodyHash:  bodyHash,
+		CreatedAt: time.Now(),
+	}
+
+	if _, err := collection.InsertOne(ctx, record); err == nil {
+		return record, true, nil
+	} else if !mongo.IsDuplicateKeyError(err) {
+		return IdempotencyRecord{}, false, err
+	}
+
+	var existing IdempotencyRecord
+	if err := collection.FindOne(ctx, bson.M{"key": key, "route": route}).Decode(&existing); err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+	if existing.Done || time.Since(existing.CreatedAt) < IdempotencyClaimTimeout {
+		return existing, false, nil
+	}
+
+	// only one retry wins the stale claim, the others see it in progress
+	filter := bson.M{"key": key, "route": route, "done": false, "created_at": existing.CreatedAt}
+	update := bson.M{"$set": bson.M{"body_hash": bodyHash, "created_at": record.CreatedAt}}
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+	if result.ModifiedCount == 0 {
+		existing.BodyHash = bodyHash
+		return existing, false, nil
+	}
+
+	return record, true, nil
+}
+
+func CompleteIdempotencyKey(key string, route string, code int, body []byte) error {
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Idempotency)
+
+	filter := bson.M{"key": key, "route": route}
+	update := bson.M{"$set": bson.M{"done": true, "code": code, "body": body}}
+
+	if _, err := collection.UpdateOne(ctx, filter, update); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func ReleaseIdempotencyKey(key string, route string) error {
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Idempotency)
+
+	if _, err := collection.DeleteOne(ctx, bson.M{"key": key, "route": route}); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,468 @@
+package mongodb
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"strings"
+	"time"
+)
+
+// System accounts stand for money outside the users' accounts. They have no
+// document in accounts; their balance only exists in the ledger.
+const (
+	SystemCash       = "system:cash"
+	SystemCard       = "system:card"
+	SystemVoucher    = "system:voucher"
+	SystemFx         = "system:fx"
+	SystemAdjustment = "system:adjustment"
+)
+
+func IsSystemAccount(id string) bool {
+	return strings.HasPrefix(id, "system:")
+}
+
+// tenderAccount is the system account a payment that is not made from an
+// account comes from.
+func tenderAccount(method TenderType) string {
+	switch method {
+	case TenderCard:
+		return SystemCard
+	case TenderVoucher:
+		return SystemVoucher
+	}
+	return SystemCash
+}
+
+type LedgerKind string
+
+const (
+	LedgerSale       LedgerKind = "sale"
+	LedgerRefund     LedgerKind = "refund"
+	LedgerDeposit    LedgerKind = "deposit"
+	LedgerWithdrawal LedgerKind = "withdrawal"
+	LedgerTransfer   LedgerKind = "transfer"
+	LedgerAdjustment LedgerKind = "adjustment"
+	// cash and card takings moved from a till into the seller's account
+	LedgerSettlement LedgerKind = "settlement"
+	// balances that existed before the ledger
+	LedgerOpening LedgerKind = "opening"
+)
+
+// Posting moves Amount into Account; a negative amount takes it out.
+type Posting struct {
+	Account string `json:"account" bson:"account"`
+	Amount  Money  `json:"amount" bson:"amount"`
+	// balance of Account right after the entry, zero for system accounts
+	Balance Money `json:"balance" bson:"balance"`
+}
+
+// LedgerEntry is one movement of money. Its postings add up to zero in every
+// currency; amounts changing currency go through SystemFx.
+type LedgerEntry struct {
+	Id        string     `json:"id" bson:"id"`
+	Kind      LedgerKind `json:"kind" bson:"kind"`
+	Receipt   MyId       `json:"receipt,omitempty" bson:"receipt,omitempty"`
+	Refund    MyId       `json:"refund,omitempty" bson:"refund,omitempty"`
+	Memo      string     `json:"memo,omitempty" bson:"memo,omitempty"`
+	CreatedBy string     `json:"created_by,omitempty" bson:"created_by,omitempty"`
+	CreatedAt time.Time  `json:"created_at" bson:"created_at"`
+	Postings  []Posting  `json:"postings" bson:"postings"`
+}
+
+// balance checks that the postings cancel out per currency. An entry in more
+// than one currency gets SystemFx postings taking up the difference of each.
+func (e *LedgerEntry) balance() error {
+	var currencies []Currency
+	sums := map[Currency]Money{}
+
+	for _, posting := range e.Postings {
+		currency := posting.Amount.Currency.orDefault()
+		sum, ok := sums[currency]
+		if !ok {
+			currencies = append(currencies, currency)
+		}
+		var err error
+		if sums[currency], err = sum.Add(posting.Amount); err != nil {
+			return err
+		}
+	}
+
+	if len(currencies) == 1 {
+		if sum := sums[currencies[0]]; !sum.IsZero() {
+			return fmt.Errorf("%w: off by %s %s", ErrUnbalancedEntry, sum, currencies[0])
+		}
+		return nil
+	}
+
+	for _, currency := range currencies {
+		if sum := sums[currency]; !sum.IsZero() {
+			e.Postings = append(e.Postings, Posting{Account: SystemFx, Amount: sum.Neg()})
+		}
+	}
+	return nil
+}
+
+// recordEntry writes an entry for balance changes already applied with
+// UpdateAccount in the same transaction, filling in its id and the resulting
+// balances.
+func recordEntry(ctx context.Context, entry *LedgerEntry) error {
+	if err := entry.balance(); err != nil {
+		return err
+	}
+
+	for i, posting := range entry.Postings {
+		if IsSystemAccount(posting.Account) {
+			continue
+		}
+		account, err := getAccount(ctx, posting.Account)
+		if err != nil {
+			return err
+		}
+		entry.Postings[i].Balance = account.Balance
+	}
+
+	entry.Id = primitive.NewObjectID().Hex()
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now()
+	}
+
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Ledger)
+	if _, err := collection.InsertOne(ctx, entry); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// StatementLine is an entry as seen from one account.
+type StatementLine struct {
+	Entry         string     `json:"entry" bson:"entry"`
+	Kind          LedgerKind `json:"kind" bson:"kind"`
+	Receipt       MyId       `json:"receipt,omitempty" bson:"receipt,omitempty"`
+	ReceiptNumber string     `json:"receipt_number,omitempty" bson:"receipt_number,omitempty"`
+	Refund        MyId       `json:"refund,omitempty" bson:"refund,omitempty"`
+	Memo          string     `json:"memo,omitempty" bson:"memo,omitempty"`
+	By            string     `json:"by,omitempty" bson:"by,omitempty"`
+	At            time.Time  `json:"at" bson:"at"`
+	Amount        Money      `json:"amount" bson:"amount"`
+	Balance       Money      `json:"balance" bson:"balance"`
+	// the other side of the entry: where the money came from or went to
+	Counterparts []Counterpart `json:"counterparts,omitempty" bson:"counterparts,omitempty"`
+}
+
+type Counterpart struct {
+	Account string `json:"account" bson:"account"`
+	Amount  Money  `json:"amount" bson:"amount"`
+}
+
+func statementLine(entry LedgerEntry, accountId string) (StatementLine, error) {
+	line := StatementLine{
+		Entry:   entry.Id,
+		Kind:    entry.Kind,
+		Receipt: entry.Receipt,
+		Refund:  entry.Refund,
+		Memo:    entry.Memo,
+		By:      entry.CreatedBy,
+		At:      entry.CreatedAt,
+	}
+
+	for _, posting := range entry.Postings {
+		if posting.Account != accountId {
+			line.Counterparts = append(line.Counterparts, Counterpart{Account: posting.Account, Amount: posting.Amount})
+			continue
+		}
+		var err error
+		if line.Amount, err = line.Amount.Add(posting.Amount); err != nil {
+			return StatementLine{}, err
+		}
+		line.Balance = posting.Balance
+	}
+
+	return line, nil
+}
+
+const (
+	DefaultStatementPageSize = 50
+	MaxStatementPageSize     = 500
+	// keeps the number of lines skipped well within range
+	MaxStatementPage = 1000000
+)
+
+// StatementQuery picks a page of the movements between From and To, both
+// optional; To is exclusive. Pages start at 1.
+type StatementQuery struct {
+	From     *time.Time `json:"from"`
+	To       *time.Time `json:"to"`
+	Page     int        `json:"page"`
+	PageSize int        `json:"page_size"`
+}
+
+type Statement struct {
+	Account  string          `json:"account"`
+	Currency Currency        `json:"currency"`
+	Page     int             `json:"page"`
+	PageSize int             `json:"page_size"`
+	Total    int64           `json:"total"`
+	Lines    []StatementLine `json:"lines"`
+}
+
+// statementPage checks a statement query and fills in its page defaults,
+// returning how many lines come before the page.
+func statementPage(query StatementQuery) (StatementQuery, int64, error) {
+	if query.From != nil && query.To != nil && !query.From.Before(*query.To) {
+		return StatementQuery{}, 0, ErrInvalidPeriod
+	}
+	if query.Page > MaxStatementPage {
+		return StatementQuery{}, 0, fmt.Errorf("%w: at most %d", ErrInvalidPage, MaxStatementPage)
+	}
+	if query.Page < 1 {
+		query.Page = 1
+	}
+	if query.PageSize <= 0 {
+		query.PageSize = DefaultStatementPageSize
+	}
+	if query.PageSize > MaxStatementPageSize {
+		query.PageSize = MaxStatementPageSize
+	}
+
+	return query, int64(query.Page-1) * int64(query.PageSize), nil
+}
+
+// GetStatement lists the movements of an account in a period, oldest first,
+// each with the balance it left.
+func GetStatement(accountId string, query StatementQuery) (Statement, error) {
+	query, skip, err := statementPage(query)
+	if err != nil {
+		return Statement{}, err
+	}
+
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+
+	account, err := getAccount(ctx, accountId)
+	if err != nil {
+		return Statement{}, err
+	}
+
+	filter := bson.M{"postings.account": accountId}
+	period := bson.M{}
+	if query.From != nil {
+		period["$gte"] = *query.From
+	}
+	if query.To != nil {
+		period["$lt"] = *query.To
+	}
+	if len(period) > 0 {
+		filter["created_at"] = period
+	}
+
+	db := Client.Database(MyDb.DbName)
+	collection := db.Collection(MyDb.Ledger)
+
+	total, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return Statement{}, err
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}).
+		SetSkip(skip).
+		SetLimit(int64(query.PageSize))
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return Statement{}, err
+	}
+
+	var entries []LedgerEntry
+	if err = cursor.All(ctx, &entries); err != nil {
+		return Statement{}, err
+	}
+
+	statement := Statement{
+		Account:  accountId,
+		Currency: account.Currency(),
+		Page:     query.Page,
+		PageSize: query.PageSize,
+		Total:    total,
+		Lines:    []StatementLine{},
+	}
+
+	var receiptIds bson.A
+	for _, entry := range entries {
+		line, err := statementLine(entry, accountId)
+		if err != nil {
+			return Statement{}, err
+		}
+		if line.Receipt != 0 {
+			receiptIds = append(receiptIds, line.Receipt)
+		}
+		statement.Lines = append(statement.Lines, line)
+	}
+
+	if len(receiptIds) == 0 {
+		return statement, nil
+	}
+
+	projection := options.Find().SetProjection(bson.M{"id": 1, "number": 1})
+	cursor, err = db.Collection(MyDb.Receipts).Find(ctx, bson.M{"id": bson.M{"$in": receiptIds}}, projection)
+	if err != nil {
+		return Statement{}, err
+	}
+
+	var receipts []Receipt
+	if err = cursor.All(ctx, &receipts); err != nil {
+		return Statement{}, err
+	}
+
+	numbers := map[MyId]string{}
+	for _, receipt := range receipts {
+		numbers[receipt.Id] = receipt.Number
+	}
+	for i := range statement.Lines {
+		statement.Lines[i].ReceiptNumber = numbers[statement.Lines[i].Receipt]
+	}
+
+	return statement, nil
+}
+
+// AccountBalance is an account as its owner sees it. Available is what can
+// still be spent, the balance plus the credit limit.
+type AccountBalance struct {
+	Id          string   `json:"id"`
+	Currency    Currency `json:"currency"`
+	Balance     Money    `json:"balance"`
+	CreditLimit Money    `json:"credit_limit"`
+	Available   Money    `json:"available"`
+}
+
+func GetAccountBalance(accountId string) (AccountBalance, error) {
+	account, err := GetAccount(accountId)
+	if err != nil {
+		return AccountBalance{}, err
+	}
+
+	available, err := account.Balance.Add(account.CreditLimit)
+	if err != nil {
+		return AccountBalance{}, err
+	}
+
+	return AccountBalance{
+		Id:          account.Id,
+		Currency:    account.Currency(),
+		Balance:     account.Balance,
+		CreditLimit: account.CreditLimit,
+		Available:   available,
+	}, nil
+}
+
+// ledgerBalances sums the postings of every user account in the ledger.
+func ledgerBalances(ctx context.Context) (map[string]Money, error) {
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Ledger)
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$unwind", Value: "$postings"}},
+		{{Key: "$match", Value: bson.M{"postings.account": bson.M{"$not": primitive.Regex{Pattern: "^system:"}}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"account": "$postings.account", "currency": "$postings.amount.currency"},
+			"total": bson.M{"$sum": "$postings.amount.amount"},
+		}}},
+	}
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		Id struct {
+			Account  string   `bson:"account"`
+			Currency Currency `bson:"currency"`
+		} `bson:"_id"`
+		Total primitive.Decimal128 `bson:"total"`
+	}
+	if err = cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+
+	balances := map[string]Money{}
+	for _, row := range rows {
+		total, err := ParseMoney(row.Total.String(), row.Id.Currency)
+		if err != nil {
+			return nil, err
+		}
+		if balances[row.Id.Account], err = balances[row.Id.Account].Add(total); err != nil {
+			return nil, fmt.Errorf("account %s: %w", row.Id.Account, err)
+		}
+	}
+
+	return balances, nil
+}
+
+// Discrepancy is an account whose balance is not what its ledger adds up to.
+type Discrepancy struct {
+	Account string `json:"account"`
+	Balance Money  `json:"balance"`
+	Ledger  Money  `json:"ledger"`
+}
+
+// ReconcileAccounts compares every account balance with its ledger.
+func ReconcileAccounts() ([]Discrepancy, error) {
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Minute)
+
+	ledger, err := ledgerBalances(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Accounts)
+	cursor, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	var accounts []Account
+	if err = cursor.All(ctx, &accounts); err != nil {
+		return nil, err
+	}
+
+	var discrepancies []Discrepancy
+	for _, account := range accounts {
+		expected := ledger[account.Id]
+		if c, err := account.Balance.Cmp(expected); err != nil || c != 0 {
+			discrepancies = append(discrepancies, Discrepancy{Account: account.Id, Balance: account.Balance, Ledger: expected})
+		}
+	}
+
+	return discrepancies, nil
+}
+
+// AdjustAccount corrects the balance of a user's account by a signed amount,
+// against SystemAdjustment.
+func AdjustAccount(session Session, username string, amount Money, memo string) error {
+	if amount.IsZero() {
+		return ErrInvalidAmount
+	}
+
+	return RunTransaction(func(sessCtx mongo.SessionContext) error {
+		user, err := getUser(sessCtx, username)
+		if err != nil {
+			return err
+		}
+		if err := UpdateAccount(sessCtx, user.AccountId, amount); err != nil {
+			return err
+		}
+
+		entry := LedgerEntry{
+			Kind:      LedgerAdjustment,
+			Memo:      memo,
+			CreatedBy: session.Username,
+			Postings: []Posting{
+				{Account: user.AccountId, Amount: amount},
+				{Account: SystemAdjustment, Amount: amount.Neg()},
+			},
+		}
+		return recordEntry(sessCtx, &entry)
+	})
+}
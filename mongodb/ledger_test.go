@@ -0,0 +1,221 @@
+package mongodb
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLedgerEntryBalance(t *testing.T) {
+	tests := []struct {
+		name     string
+		postings []Posting
+		want     []Posting
+	}{
+		{
+			name:     "balanced",
+			postings: []Posting{{Account: "a", Amount: ron(500)}, {Account: SystemCash, Amount: ron(-500)}},
+			want:     []Posting{{Account: "a", Amount: ron(500)}, {Account: SystemCash, Amount: ron(-500)}},
+		},
+		{
+			name:     "default currency",
+			postings: []Posting{{Account: "a", Amount: Money{500, ""}}, {Account: "b", Amount: ron(-500)}},
+			want:     []Posting{{Account: "a", Amount: Money{500, ""}}, {Account: "b", Amount: ron(-500)}},
+		},
+		{
+			name:     "across currencies",
+			postings: []Posting{{Account: "a", Amount: ron(-500)}, {Account: "b", Amount: Money{100, CurrencyEUR}}},
+			want: []Posting{
+				{Account: "a", Amount: ron(-500)},
+				{Account: "b", Amount: Money{100, CurrencyEUR}},
+				{Account: SystemFx, Amount: ron(500)},
+				{Account: SystemFx, Amount: Money{-100, CurrencyEUR}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		entry := LedgerEntry{Postings: tt.postings}
+		if err := entry.balance(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(entry.Postings, tt.want) {
+			t.Errorf("%s = %+v, want %+v", tt.name, entry.Postings, tt.want)
+		}
+	}
+
+	entry := LedgerEntry{Postings: []Posting{{Account: "a", Amount: ron(500)}, {Account: "b", Amount: ron(-499)}}}
+	if err := entry.balance(); !errors.Is(err, ErrUnbalancedEntry) {
+		t.Errorf("entry off by a unit: error = %v, want %v", err, ErrUnbalancedEntry)
+	}
+}
+
+func TestStatementLine(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	entry := LedgerEntry{
+		Id:        "e1",
+		Kind:      LedgerSale,
+		Receipt:   7,
+		CreatedBy: "seller1",
+		CreatedAt: at,
+		Postings: []Posting{
+			{Account: "buyer", Amount: ron(-1500), Balance: ron(500)},
+			{Account: "seller", Amount: ron(1500), Balance: ron(9000)},
+		},
+	}
+
+	tests := []struct {
+		account string
+		want    StatementLine
+	}{
+		{
+			account: "buyer",
+			want: StatementLine{
+				Entry: "e1", Kind: LedgerSale, Receipt: 7, By: "seller1", At: at,
+				Amount: ron(-1500), Balance: ron(500),
+				Counterparts: []Counterpart{{Account: "seller", Amount: ron(1500)}},
+			},
+		},
+		{
+			account: "seller",
+			want: StatementLine{
+				Entry: "e1", Kind: LedgerSale, Receipt: 7, By: "seller1", At: at,
+				Amount: ron(1500), Balance: ron(9000),
+				Counterparts: []Counterpart{{Account: "buyer", Amount: ron(-1500)}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := statementLine(entry, tt.account)
+		if err != nil {
+			t.Errorf("%s: %v", tt.account, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s = %+v, want %+v", tt.account, got, tt.want)
+		}
+	}
+}
+
+func TestOpeningEntry(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		balance  Money
+		ledger   Money
+		want     Money
+		wantOpen bool
+	}{
+		{name: "no entries", balance: ron(5000), ledger: Money{}, want: ron(5000), wantOpen: true},
+		{name: "entries after a balance", balance: ron(5000), ledger: ron(1200), want: ron(3800), wantOpen: true},
+		{name: "spent more than the ledger saw", balance: ron(-300), ledger: ron(200), want: ron(-500), wantOpen: true},
+		{name: "ledger adds up", balance: ron(1200), ledger: ron(1200)},
+		{name: "empty account", balance: ron(0), ledger: Money{}},
+	}
+
+	for _, tt := range tests {
+		entry, open, err := openingEntry(Account{Id: "a", Balance: tt.balance}, tt.ledger, at)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if open != tt.wantOpen {
+			t.Errorf("%s: open = %v, want %v", tt.name, open, tt.wantOpen)
+			continue
+		}
+		if !open {
+			continue
+		}
+		want := []Posting{
+			{Account: "a", Amount: tt.want, Balance: tt.want},
+			{Account: SystemAdjustment, Amount: tt.want.Neg()},
+		}
+		if entry.Kind != LedgerOpening || !entry.CreatedAt.Equal(at) || !reflect.DeepEqual(entry.Postings, want) {
+			t.Errorf("%s = %+v, want postings %+v", tt.name, entry, want)
+		}
+	}
+
+	if _, _, err := openingEntry(Account{Id: "a", Balance: ron(100)}, Money{100, CurrencyEUR}, at); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("ledger in another currency: error = %v, want %v", err, ErrCurrencyMismatch)
+	}
+}
+
+// An account that had a balance before the ledger and has been used since gets
+// the difference as its opening, before its first entry, and only once.
+func TestMigrateOpeningBalances(t *testing.T) {
+	testDb(t)
+
+	account := testUser(t, "buyer1", ProfileTypeBuyer, CurrencyRON)
+	testFund(t, account, ron(5000))
+	if _, err := Deposit(Session{Username: "teller1", Profile: ProfileTypeManager}, "buyer1", ron(1200), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for run := 0; run < 2; run++ {
+		if err := migrateOpeningBalances(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	statement, err := GetStatement(account, StatementQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statement.Lines) != 2 {
+		t.Fatalf("%d statement lines, want 2: %+v", len(statement.Lines), statement.Lines)
+	}
+	opening, deposit := statement.Lines[0], statement.Lines[1]
+	if opening.Kind != LedgerOpening || opening.Amount != ron(5000) || opening.Balance != ron(5000) {
+		t.Errorf("opening line %+v", opening)
+	}
+	if deposit.Kind != LedgerDeposit || deposit.Balance != ron(6200) {
+		t.Errorf("deposit line %+v", deposit)
+	}
+
+	discrepancies, err := ReconcileAccounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(discrepancies) != 0 {
+		t.Errorf("discrepancies %+v", discrepancies)
+	}
+}
+
+func TestStatementPage(t *testing.T) {
+	from := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(24 * time.Hour)
+
+	tests := []struct {
+		name         string
+		query        StatementQuery
+		wantPage     int
+		wantPageSize int
+		wantSkip     int64
+		wantErr      error
+	}{
+		{name: "defaults", query: StatementQuery{}, wantPage: 1, wantPageSize: DefaultStatementPageSize, wantSkip: 0},
+		{name: "third page", query: StatementQuery{Page: 3, PageSize: 20}, wantPage: 3, wantPageSize: 20, wantSkip: 40},
+		{name: "negative page", query: StatementQuery{Page: -4}, wantPage: 1, wantPageSize: DefaultStatementPageSize, wantSkip: 0},
+		{name: "page size capped", query: StatementQuery{Page: 2, PageSize: 100000}, wantPage: 2, wantPageSize: MaxStatementPageSize, wantSkip: MaxStatementPageSize},
+		{name: "last page", query: StatementQuery{Page: MaxStatementPage, PageSize: MaxStatementPageSize}, wantPage: MaxStatementPage, wantPageSize: MaxStatementPageSize, wantSkip: (MaxStatementPage - 1) * MaxStatementPageSize},
+		{name: "page past the last", query: StatementQuery{Page: MaxStatementPage + 1}, wantErr: ErrInvalidPage},
+		{name: "huge page", query: StatementQuery{Page: int(^uint(0) >> 1), PageSize: MaxStatementPageSize}, wantErr: ErrInvalidPage},
+		{name: "period", query: StatementQuery{From: &from, To: &to}, wantPage: 1, wantPageSize: DefaultStatementPageSize, wantSkip: 0},
+		{name: "empty period", query: StatementQuery{From: &to, To: &from}, wantErr: ErrInvalidPeriod},
+	}
+
+	for _, tt := range tests {
+		got, skip, err := statementPage(tt.query)
+		if testError(t, tt.name, err, tt.wantErr) {
+			continue
+		}
+		if got.Page != tt.wantPage || got.PageSize != tt.wantPageSize || skip != tt.wantSkip {
+			t.Errorf("%s = page %d of %d skipping %d, want page %d of %d skipping %d",
+				tt.name, got.Page, got.PageSize, skip, tt.wantPage, tt.wantPageSize, tt.wantSkip)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package mongodb
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"time"
+)
+
+// mergeProducts folds lines of the same product into one, keeping the order
+// in which products first appear.
+func mergeProducts(products []ReceiptProduct) []ReceiptProduct {
+	var merged []ReceiptProduct
+	index := map[string]int{}
+
+	for _, product := range products {
+		if i, ok := index[product.Id]; ok {
+			merged[i].Quantity += product.Quantity
+			continue
+		}
+		index[product.Id] = len(merged)
+		merged = append(merged, product)
+	}
+
+	return merged
+}
+
+// openReceiptOf reads receipt id for an edit by its seller.
+func openReceiptOf(ctx context.Context, session Session, id int) (Receipt, error) {
+	receipt, err := getReceipt(ctx, id)
+	if err != nil {
+		return Receipt{}, err
+	}
+	if receipt.Status != ReceiptStatusOpened {
+		return Receipt{}, ErrReceiptNotOpen
+	}
+	if receipt.Expired(time.Now()) {
+		return Receipt{}, ErrReceiptExpired
+	}
+	if receipt.Seller != session.Username {
+		return Receipt{}, ErrForbidden
+	}
+	// the total must not move under payments already taken
+	if len(receipt.Payments) > 0 {
+		return Receipt{}, ErrReceiptPartlyPaid
+	}
+
+	// receipts opened before reservations hold nothing yet; hold all of their
+	// lines now, so an edit only has to move the difference and the receipt
+	// expires like any other
+	if held, err := hasReservation(ctx, receipt.Id); err != nil {
+		return Receipt{}, err
+	} else if !held {
+		if err := ReserveStock(ctx, receipt); err != nil {
+			return Receipt{}, err
+		}
+	}
+
+	return receipt, nil
+}
+
+// storeOpenReceipt writes the lines and prices of an edited receipt and its
+// reservation, and gives both a fresh expiry.
+func storeOpenReceipt(ctx context.Context, receipt *Receipt) error {
+	receipt.ExpiresAt = time.Now().Add(ReservationTTL)
+
+	db := Client.Database(MyDb.DbName)
+	filter := bson.M{"id": receipt.Id, "status": ReceiptStatusOpened}
+	update := bson.M{"$set": bson.M{
+		"products":   receipt.Products,
+		"subtotal":   receipt.Subtotal,
+		"discount":   receipt.Discount,
+		"coupons":    receipt.Coupons,
+		"promotions": receipt.Promotions,
+		"net":        receipt.Net,
+		"tax":        receipt.Tax,
+		"taxes":      receipt.Taxes,
+		"total":      receipt.TotalPrice,
+		"expires_at": receipt.ExpiresAt,
+	}}
+	if _, err := db.Collection(MyDb.Receipts).UpdateOne(ctx, filter, update); err != nil {
+		return err
+	}
+
+	update = bson.M{"$set": bson.M{"products": receipt.Products, "expires_at": receipt.ExpiresAt}}
+	result, err := db.Collection(MyDb.Reservations).UpdateOne(ctx, bson.M{"receipt": receipt.Id}, update)
+	if err != nil {
+		return err
+	}
+	// the hold ran out, see openReceiptOf
+	if result.MatchedCount == 0 {
+		return ErrReceiptNotOpen
+	}
+
+	return nil
+}
+
+// editLine sets the quantity of productId on an open receipt of the caller to
+// whatever quantity returns for the current line, if there is one. A result of
+// 0 removes the line. Held stock, prices and expiry are updated with it.
+func editLine(session Session, id int, productId string, quantity func(current float32, found bool) (float32, error)) (Receipt, error) {
+	var receipt Receipt
+	err := RunTransaction(func(sessCtx mongo.SessionContext) error {
+		var err error
+		if receipt, err = openReceiptOf(sessCtx, session, id); err != nil {
+			return err
+		}
+
+		line := -1
+		var current float32
+		for i, product := range receipt.Products {
+			if product.Id == productId {
+				line = i
+				current = product.Quantity
+			}
+		}
+
+		wanted, err := quantity(current, line >= 0)
+		if err != nil {
+			return err
+		}
+
+		switch delta := wanted - current; {
+		case delta > 0:
+			if err := holdStock(sessCtx, productId, delta); err != nil {
+				return err
+			}
+		case delta < 0:
+			if err := unholdStock(sessCtx, productId, -delta); err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case line < 0 && wanted > 0:
+			var added []ReceiptProduct
+			if added, err = SnapshotProducts([]ReceiptProduct{{Id: productId, Quantity: wanted}}); err != nil {
+				return err
+			}
+			receipt.Products = append(receipt.Products, added...)
+		case line >= 0 && wanted == 0:
+			receipt.Products = append(receipt.Products[:line], receipt.Products[line+1:]...)
+		case line >= 0:
+			// the unit price stays the one the line was created with
+			receipt.Products[line].Quantity = wanted
+		}
+
+		// promotions such as multi-buy depend on the quantities
+		if err = PriceReceipt(sessCtx, &receipt, time.Now()); err != nil {
+			return err
+		}
+
+		return storeOpenReceipt(sessCtx, &receipt)
+	})
+	if err != nil {
+		return Receipt{}, err
+	}
+
+	return receipt, nil
+}
+
+// AddReceiptLine scans quantity more of a product; a product already on the
+// receipt gets its line increased instead of a second line.
+func AddReceiptLine(session Session, id int, productId string, quantity float32) (Receipt, error) {
+	if quantity <= 0 {
+		return Receipt{}, ErrInvalidQuantity
+	}
+	return editLine(session, id, productId, func(current float32, found bool) (float32, error) {
+		return current + quantity, nil
+	})
+}
+
+func SetReceiptLineQuantity(session Session, id int, productId string, quantity float32) (Receipt, error) {
+	if quantity <= 0 {
+		return Receipt{}, ErrInvalidQuantity
+	}
+	return editLine(session, id, productId, func(current float32, found bool) (float32, error) {
+		if !found {
+			return 0, ErrLineNotFound
+		}
+		return quantity, nil
+	})
+}
+
+func RemoveReceiptLine(session Session, id int, productId string) (Receipt, error) {
+	return editLine(session, id, productId, func(current float32, found bool) (float32, error) {
+		if !found {
+			return 0, ErrLineNotFound
+		}
+		return 0, nil
+	})
+}
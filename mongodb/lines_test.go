@@ -0,0 +1,56 @@
+package mongodb
+
+import (
+	"testing"
+	"time"
+)
+
+// Editing a receipt opened before reservations holds all of its lines, not
+// only the added quantity, and gives it an expiry so the hold is let go.
+func TestEditLegacyOpenReceipt(t *testing.T) {
+	testDb(t)
+
+	testInsert(t, MyDb.Products, Product{
+		Id:             "p1",
+		Name:           "apples",
+		Price:          ron(500),
+		TaxCategory:    TaxCategoryStandard,
+		TotalAvailable: 10,
+		Stocks:         []ProductStock{{Id: "p1", TotalAvailable: 10}},
+	})
+	testInsert(t, MyDb.Receipts, Receipt{
+		Id:         1,
+		Seller:     "seller1",
+		Status:     ReceiptStatusOpened,
+		CreatedAt:  time.Now(),
+		Products:   []ReceiptProduct{{Id: "p1", Quantity: 2, UnitPrice: ron(500), LineTotal: ron(1000)}},
+		Subtotal:   ron(1000),
+		TotalPrice: ron(1000),
+	})
+
+	seller := Session{Username: "seller1", Profile: ProfileTypeSeller}
+	receipt, err := AddReceiptLine(seller, 1, "p1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.ExpiresAt.IsZero() {
+		t.Error("edited receipt has no expiry")
+	}
+	product, err := GetProduct("p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if product.TotalReserved != 3 {
+		t.Errorf("reserved %v, want 3", product.TotalReserved)
+	}
+
+	if _, err := CancelReceipt(seller, 1, CancelReasonCustomerLeft); err != nil {
+		t.Fatal(err)
+	}
+	if product, err = GetProduct("p1"); err != nil {
+		t.Fatal(err)
+	}
+	if product.TotalReserved != 0 {
+		t.Errorf("reserved %v after cancelling, want 0", product.TotalReserved)
+	}
+}
@@ -0,0 +1,343 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+	"sort"
+	"time"
+)
+
+// Migrate rewrites documents stored in older formats. Every step only touches
+// documents that still need it, so it is safe to run more than once.
+func Migrate() error {
+	if err := migrateMoney(); err != nil {
+		return err
+	}
+	if err := migrateSessions(); err != nil {
+		return err
+	}
+	if err := migrateIdGenerator(); err != nil {
+		return err
+	}
+	if err := migrateTaxCategories(); err != nil {
+		return err
+	}
+	if err := migratePromotionBasisPoints(); err != nil {
+		return err
+	}
+	if err := migrateOpeningBalances(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// migrateCollection decodes every document matching filter and sets the fields
+// returned by rewrite on it.
+func migrateCollection(name string, filter bson.M, rewrite func(raw bson.Raw) (bson.M, error)) error {
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Minute)
+	collection := Client.Database(MyDb.DbName).Collection(name)
+
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	count := 0
+	for cursor.Next(ctx) {
+		fields, err := rewrite(cursor.Current)
+		if err != nil {
+			return err
+		}
+
+		id := cursor.Current.Lookup("_id")
+		if _, err := collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": fields}); err != nil {
+			return err
+		}
+		count++
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	fmt.Printf("migrated %d documents in %s\n", count, name)
+	return nil
+}
+
+// migrateMoney converts float balances and prices to Money documents.
+func migrateMoney() error {
+	legacy := bson.M{"$exists": true, "$not": bson.M{"$type": "object"}}
+
+	err := migrateCollection(MyDb.Accounts, bson.M{"balance": legacy}, func(raw bson.Raw) (bson.M, error) {
+		var account Account
+		if err := bson.Unmarshal(raw, &account); err != nil {
+			return nil, err
+		}
+		return bson.M{"balance": account.Balance}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	productFilter := bson.M{"$or": []bson.M{{"price": legacy}, {"stocks.price": legacy}}}
+	err = migrateCollection(MyDb.Products, productFilter, func(raw bson.Raw) (bson.M, error) {
+		var product Product
+		if err := bson.Unmarshal(raw, &product); err != nil {
+			return nil, err
+		}
+		return bson.M{"price": product.Price, "stocks": product.Stocks}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return migrateCollection(MyDb.Receipts, bson.M{"total": legacy}, func(raw bson.Raw) (bson.M, error) {
+		var receipt Receipt
+		if err := bson.Unmarshal(raw, &receipt); err != nil {
+			return nil, err
+		}
+		return bson.M{"total": receipt.TotalPrice}, nil
+	})
+}
+
+// migrateSessions drops sessions created before they had an expiry or a hashed
+// token; the TTL index never removes them and GetSession no longer accepts them.
+func migrateSessions() error {
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Minute)
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Sessions)
+
+	filter := bson.M{"$or": []bson.M{
+		{"expires_at": bson.M{"$exists": false}},
+		{"token_hash": bson.M{"$exists": false}},
+	}}
+	result, err := collection.DeleteMany(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("removed %d legacy sessions\n", result.DeletedCount)
+	return nil
+}
+
+// migrateIdGenerator turns the single unnamed id_generator document, which held
+// the next receipt id, into the "receipts" sequence, which holds the last one.
+func migrateIdGenerator() error {
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Minute)
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.IdGenerator)
+
+	filter := bson.M{"name": bson.M{"$exists": false}}
+	update := bson.M{
+		"$set": bson.M{"name": SequenceReceipts},
+		"$inc": bson.M{"id": -1},
+	}
+
+	result, err := collection.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("migrated %d documents in %s\n", result.ModifiedCount, MyDb.IdGenerator)
+	return nil
+}
+
+// legacyTaxCategory is the category for a product stored with a bare
+// tax_rate: the one having that rate, the first by name when several share it
+// so every run picks the same one. An explicit rate of 0 is an exempt product;
+// a missing rate or one no category has gets the standard category.
+func legacyTaxCategory(raw bson.Raw, rates map[TaxCategory]TaxRate, categories []TaxCategory) (TaxCategory, error) {
+	value, err := raw.LookupErr("tax_rate")
+	if errors.Is(err, bsoncore.ErrElementNotFound) {
+		return TaxCategoryStandard, nil
+	} else if err != nil {
+		return "", err
+	}
+	var rate TaxRate
+	if err := value.Unmarshal(&rate); err != nil {
+		return "", err
+	}
+
+	if rates[TaxCategoryStandard] == rate {
+		return TaxCategoryStandard, nil
+	}
+	for _, c := range categories {
+		if rates[c] == rate {
+			return c, nil
+		}
+	}
+	if rate == 0 {
+		return TaxCategoryExempt, nil
+	}
+	return TaxCategoryStandard, nil
+}
+
+// migrateTaxCategories gives products stored with a bare tax_rate a category,
+// see legacyTaxCategory.
+func migrateTaxCategories() error {
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	rates, err := GetTaxRates(ctx)
+	if err != nil {
+		return err
+	}
+
+	var categories []TaxCategory
+	for category := range rates {
+		categories = append(categories, category)
+	}
+	sort.Slice(categories, func(i, j int) bool { return categories[i] < categories[j] })
+
+	filter := bson.M{"tax_category": bson.M{"$exists": false}}
+	return migrateCollection(MyDb.Products, filter, func(raw bson.Raw) (bson.M, error) {
+		category, err := legacyTaxCategory(raw, rates, categories)
+		if err != nil {
+			return nil, err
+		}
+		return bson.M{"tax_category": category}, nil
+	})
+}
+
+// migratePromotionBasisPoints renames the percent field of promotions, which
+// always held basis points, to basis_points.
+func migratePromotionBasisPoints() error {
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Minute)
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Promotions)
+
+	filter := bson.M{"percent": bson.M{"$exists": true}}
+	update := bson.M{"$rename": bson.M{"percent": "basis_points"}}
+
+	result, err := collection.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("migrated %d documents in %s\n", result.ModifiedCount, MyDb.Promotions)
+	return nil
+}
+
+// openingEntry opens the ledger of an account with what its balance has that
+// the ledger does not, dated at, the balance posting showing the difference as
+// the balance. It is false when the ledger already adds up.
+func openingEntry(account Account, ledger Money, at time.Time) (LedgerEntry, bool, error) {
+	difference, err := account.Balance.Sub(ledger)
+	if err != nil {
+		return LedgerEntry{}, false, fmt.Errorf("account %s: %w", account.Id, err)
+	}
+	if difference.IsZero() {
+		return LedgerEntry{}, false, nil
+	}
+
+	entry := LedgerEntry{
+		Kind:      LedgerOpening,
+		CreatedAt: at,
+		Postings: []Posting{
+			{Account: account.Id, Amount: difference, Balance: difference},
+			{Account: SystemAdjustment, Amount: difference.Neg()},
+		},
+	}
+	if err := entry.balance(); err != nil {
+		return LedgerEntry{}, false, err
+	}
+	return entry, true, nil
+}
+
+// ledgerStart is when the ledger of an account starts and whether it has been
+// opened already.
+type ledgerStart struct {
+	First  time.Time
+	Opened bool
+}
+
+func ledgerStarts(ctx context.Context) (map[string]ledgerStart, error) {
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Ledger)
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$unwind", Value: "$postings"}},
+		{{Key: "$match", Value: bson.M{"postings.account": bson.M{"$not": primitive.Regex{Pattern: "^system:"}}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":    "$postings.account",
+			"first":  bson.M{"$min": "$created_at"},
+			"opened": bson.M{"$max": bson.M{"$eq": bson.A{"$kind", LedgerOpening}}},
+		}}},
+	}
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		Account string    `bson:"_id"`
+		First   time.Time `bson:"first"`
+		Opened  bool      `bson:"opened"`
+	}
+	if err = cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+
+	starts := map[string]ledgerStart{}
+	for _, row := range rows {
+		starts[row.Account] = ledgerStart{First: row.First, Opened: row.Opened}
+	}
+	return starts, nil
+}
+
+// migrateOpeningBalances opens the ledger of every account with the part of
+// its balance from before the ledger existed: the difference between the
+// balance and what its entries add up to, dated just before its first entry so
+// statements show the right running balance. Accounts opened already are left
+// alone; any difference they have is for "banking reconcile" to show.
+func migrateOpeningBalances() error {
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Minute)
+
+	ledger, err := ledgerBalances(ctx)
+	if err != nil {
+		return err
+	}
+	starts, err := ledgerStarts(ctx)
+	if err != nil {
+		return err
+	}
+
+	db := Client.Database(MyDb.DbName)
+	cursor, err := db.Collection(MyDb.Accounts).Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+
+	var accounts []Account
+	if err = cursor.All(ctx, &accounts); err != nil {
+		return err
+	}
+
+	count := 0
+	for _, account := range accounts {
+		start, ok := starts[account.Id]
+		if start.Opened {
+			continue
+		}
+		at := time.Now()
+		if ok {
+			at = start.First.Add(-time.Millisecond)
+		}
+
+		entry, open, err := openingEntry(account, ledger[account.Id], at)
+		if err != nil {
+			return err
+		}
+		if !open {
+			continue
+		}
+		entry.Id = primitive.NewObjectID().Hex()
+		if _, err := db.Collection(MyDb.Ledger).InsertOne(ctx, entry); err != nil {
+			return err
+		}
+		count++
+	}
+
+	fmt.Printf("opened %d accounts in %s\n", count, MyDb.Ledger)
+	return nil
+}
@@ -0,0 +1,54 @@
+package mongodb
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"testing"
+)
+
+func TestLegacyTaxCategory(t *testing.T) {
+	rates := map[TaxCategory]TaxRate{
+		TaxCategoryStandard: 19,
+		TaxCategoryReduced:  9,
+		"books":             5,
+		"food":              9,
+		TaxCategoryExempt:   0,
+	}
+	categories := []TaxCategory{"books", TaxCategoryExempt, "food", TaxCategoryReduced, TaxCategoryStandard}
+
+	tests := []struct {
+		name string
+		doc  bson.M
+		want TaxCategory
+	}{
+		{"no rate", bson.M{"id": "p1"}, TaxCategoryStandard},
+		{"standard rate", bson.M{"tax_rate": 19}, TaxCategoryStandard},
+		{"only category with the rate", bson.M{"tax_rate": 5}, "books"},
+		{"shared rate takes the first by name", bson.M{"tax_rate": 9}, "food"},
+		{"explicit zero is exempt", bson.M{"tax_rate": 0}, TaxCategoryExempt},
+		{"stored as int64", bson.M{"tax_rate": int64(0)}, TaxCategoryExempt},
+		{"stored as a double", bson.M{"tax_rate": 5.0}, "books"},
+		{"rate no category has", bson.M{"tax_rate": 24}, TaxCategoryStandard},
+	}
+
+	for _, tt := range tests {
+		raw, err := bson.Marshal(tt.doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := legacyTaxCategory(raw, rates, categories)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// without a zero rate category an explicit 0 still means exempt
+	delete(rates, TaxCategoryExempt)
+	raw, _ := bson.Marshal(bson.M{"tax_rate": 0})
+	if got, err := legacyTaxCategory(raw, rates, categories[:0]); err != nil || got != TaxCategoryExempt {
+		t.Errorf("zero without an exempt rate = %q, %v, want %q", got, err, TaxCategoryExempt)
+	}
+}
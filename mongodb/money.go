@@ -0,0 +1,316 @@
+package mongodb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Money is an exact amount kept in the minor unit of its currency (bani,
+// cents). Anything that can produce digits past the minor unit (parsing,
+// multiplying by a quantity, converting legacy floats) rounds half away from
+// zero, so 0.005 becomes 0.01 and -0.005 becomes -0.01.
+//
+// In MongoDB an amount is stored as {amount: Decimal128, currency: string};
+// in JSON as {"amount": "12.34", "currency": "RON"}.
+type Money struct {
+	Amount   int64
+	Currency Currency
+}
+
+type Currency string
+
+const (
+	CurrencyRON Currency = "RON"
+	CurrencyEUR Currency = "EUR"
+	CurrencyUSD Currency = "USD"
+)
+
+var DefaultCurrency = CurrencyRON
+
+var ErrCurrencyMismatch = errors.New("currency mismatch")
+
+// currencies not listed here have two decimals
+var currencyExponents = map[Currency]int{
+	"JPY": 0,
+	"KRW": 0,
+	"BHD": 3,
+	"KWD": 3,
+	"TND": 3,
+}
+
+func (c Currency) Exponent() int {
+	if exp, ok := currencyExponents[c]; ok {
+		return exp
+	}
+	return 2
+}
+
+// Valid reports whether c looks like an ISO-4217 code.
+func (c Currency) Valid() bool {
+	if len(c) != 3 {
+		return false
+	}
+	for _, r := range c {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+func (c Currency) orDefault() Currency {
+	if c == "" {
+		return DefaultCurrency
+	}
+	return c
+}
+
+func NewMoney(amount int64, currency Currency) Money {
+	return Money{Amount: amount, Currency: currency.orDefault()}
+}
+
+// ParseMoney reads a decimal string such as "34.23" or "-1.5e2".
+func ParseMoney(s string, currency Currency) (Money, error) {
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok {
+		return Money{}, fmt.Errorf("invalid amount %q", s)
+	}
+	return moneyFromRat(r, currency)
+}
+
+func moneyFromRat(r *big.Rat, currency Currency) (Money, error) {
+	currency = currency.orDefault()
+	scaled := new(big.Rat).Mul(r, new(big.Rat).SetInt(pow10(currency.Exponent())))
+	minor := roundHalfAway(scaled)
+	if !minor.IsInt64() {
+		return Money{}, fmt.Errorf("amount %s out of range", r.FloatString(currency.Exponent()))
+	}
+	return Money{Amount: minor.Int64(), Currency: currency}, nil
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+func roundHalfAway(r *big.Rat) *big.Int {
+	num := new(big.Int).Abs(r.Num())
+	den := r.Denom()
+	q, m := new(big.Int).QuoRem(num, den, new(big.Int))
+	if new(big.Int).Mul(m, big.NewInt(2)).Cmp(den) >= 0 {
+		q.Add(q, big.NewInt(1))
+	}
+	if r.Sign() < 0 {
+		q.Neg(q)
+	}
+	return q
+}
+
+func (m Money) Rat() *big.Rat {
+	return new(big.Rat).SetFrac(big.NewInt(m.Amount), pow10(m.Currency.orDefault().Exponent()))
+}
+
+func (m Money) String() string {
+	return m.Rat().FloatString(m.Currency.orDefault().Exponent())
+}
+
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+func (m Money) IsNegative() bool {
+	return m.Amount < 0
+}
+
+func (m Money) Neg() Money {
+	return Money{Amount: -m.Amount, Currency: m.Currency}
+}
+
+// unify lets a zero amount without a currency take the other side's currency,
+// so an empty accumulator can be added to.
+func (m Money) unify(o Money) (Currency, error) {
+	switch {
+	case m.Currency == o.Currency:
+		return m.Currency.orDefault(), nil
+	case m.Currency == "" && m.Amount == 0:
+		return o.Currency, nil
+	case o.Currency == "" && o.Amount == 0:
+		return m.Currency, nil
+	}
+	return "", fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, o.Currency)
+}
+
+func (m Money) Add(o Money) (Money, error) {
+	currency, err := m.unify(o)
+	if err != nil {
+		return Money{}, err
+	}
+	return Money{Amount: m.Amount + o.Amount, Currency: currency}, nil
+}
+
+func (m Money) Sub(o Money) (Money, error) {
+	return m.Add(o.Neg())
+}
+
+func (m Money) Cmp(o Money) (int, error) {
+	if _, err := m.unify(o); err != nil {
+		return 0, err
+	}
+	switch {
+	case m.Amount < o.Amount:
+		return -1, nil
+	case m.Amount > o.Amount:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// MulQuantity prices a quantity such as 32.3 kg. The quantity is taken at its
+// shortest decimal form, so a float32 32.3 counts as exactly 32.3.
+func (m Money) MulQuantity(quantity float32) (Money, error) {
+	q, ok := new(big.Rat).SetString(strconv.FormatFloat(float64(quantity), 'g', -1, 32))
+	if !ok {
+		return Money{}, fmt.Errorf("invalid quantity %v", quantity)
+	}
+	return moneyFromRat(new(big.Rat).Mul(m.Rat(), q), m.Currency)
+}
+
+// Prorate returns the share part/whole of m, e.g. the price of 2 of 5 units.
+func (m Money) Prorate(part float32, whole float32) (Money, error) {
+	p, ok := new(big.Rat).SetString(strconv.FormatFloat(float64(part), 'g', -1, 32))
+	if !ok {
+		return Money{}, fmt.Errorf("invalid quantity %v", part)
+	}
+	w, ok := new(big.Rat).SetString(strconv.FormatFloat(float64(whole), 'g', -1, 32))
+	if !ok || w.Sign() == 0 {
+		return Money{}, fmt.Errorf("invalid quantity %v", whole)
+	}
+	return moneyFromRat(new(big.Rat).Mul(m.Rat(), new(big.Rat).Quo(p, w)), m.Currency)
+}
+
+func (m Money) Decimal128() (primitive.Decimal128, error) {
+	return primitive.ParseDecimal128(m.String())
+}
+
+type moneyDocument struct {
+	Amount   bson.RawValue `bson:"amount"`
+	Currency Currency      `bson:"currency"`
+}
+
+func (m Money) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	amount, err := m.Decimal128()
+	if err != nil {
+		return 0, nil, err
+	}
+	return bson.MarshalValue(bson.D{
+		{Key: "amount", Value: amount},
+		{Key: "currency", Value: m.Currency.orDefault()},
+	})
+}
+
+// UnmarshalBSONValue also accepts the bare numbers written before amounts were
+// stored as documents; those are read in the default currency.
+func (m *Money) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	if t == bsontype.Null || t == bsontype.Undefined {
+		*m = Money{}
+		return nil
+	}
+
+	raw := bson.RawValue{Type: t, Value: data}
+	currency := DefaultCurrency
+
+	if t == bsontype.EmbeddedDocument {
+		var doc moneyDocument
+		if err := raw.Unmarshal(&doc); err != nil {
+			return err
+		}
+		raw = doc.Amount
+		currency = doc.Currency.orDefault()
+	}
+
+	r, err := ratFromRawValue(raw)
+	if err != nil {
+		return err
+	}
+
+	money, err := moneyFromRat(r, currency)
+	if err != nil {
+		return err
+	}
+	*m = money
+	return nil
+}
+
+func ratFromRawValue(raw bson.RawValue) (*big.Rat, error) {
+	var s string
+	switch raw.Type {
+	case bsontype.Decimal128:
+		s = raw.Decimal128().String()
+	case bsontype.Double:
+		s = strconv.FormatFloat(raw.Double(), 'g', -1, 64)
+	case bsontype.Int32:
+		s = strconv.FormatInt(int64(raw.Int32()), 10)
+	case bsontype.Int64:
+		s = strconv.FormatInt(raw.Int64(), 10)
+	default:
+		return nil, fmt.Errorf("cannot decode amount from bson %s", raw.Type)
+	}
+
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, fmt.Errorf("invalid amount %q", s)
+	}
+	return r, nil
+}
+
+type moneyJSON struct {
+	Amount   json.RawMessage `json:"amount"`
+	Currency Currency        `json:"currency"`
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Amount   string   `json:"amount"`
+		Currency Currency `json:"currency"`
+	}{m.String(), m.Currency.orDefault()})
+}
+
+// UnmarshalJSON accepts {"amount": "12.34", "currency": "RON"} as well as a
+// plain number or string in the default currency, which is what clients sent
+// before amounts had a currency.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = []byte(strings.TrimSpace(string(data)))
+	if string(data) == "null" {
+		*m = Money{}
+		return nil
+	}
+
+	currency := DefaultCurrency
+	if len(data) > 0 && data[0] == '{' {
+		var doc moneyJSON
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return err
+		}
+		data = doc.Amount
+		currency = doc.Currency.orDefault()
+	}
+
+	literal := strings.Trim(string(data), `"`)
+	if literal == "" {
+		*m = Money{Currency: currency}
+		return nil
+	}
+
+	money, err := ParseMoney(literal, currency)
+	if err != nil {
+		return err
+	}
+	*m = money
+	return nil
+}
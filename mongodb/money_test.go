@@ -0,0 +1,167 @@
+package mongodb
+
+import (
+	"encoding/json"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in       string
+		currency Currency
+		want     Money
+		wantErr  bool
+	}{
+		{"34.23", "", Money{3423, CurrencyRON}, false},
+		{"0.005", "RON", Money{1, CurrencyRON}, false},
+		{"-0.005", "RON", Money{-1, CurrencyRON}, false},
+		{"0.004", "RON", Money{0, CurrencyRON}, false},
+		{"-1.5e2", "EUR", Money{-15000, CurrencyEUR}, false},
+		{"1234", "JPY", Money{1234, "JPY"}, false},
+		{"1.2345", "KWD", Money{1235, "KWD"}, false},
+		{" 7 ", "USD", Money{700, CurrencyUSD}, false},
+		{"abc", "RON", Money{}, true},
+		{"1e30", "RON", Money{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseMoney(tt.in, tt.currency)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseMoney(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseMoney(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	tests := []struct {
+		in   Money
+		want string
+	}{
+		{Money{3423, "RON"}, "34.23"},
+		{Money{-5, "RON"}, "-0.05"},
+		{Money{0, ""}, "0.00"},
+		{Money{1234, "JPY"}, "1234"},
+		{Money{1235, "KWD"}, "1.235"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.in.String(); got != tt.want {
+			t.Errorf("%+v.String() = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMoneyArithmetic(t *testing.T) {
+	tests := []struct {
+		name    string
+		op      func() (Money, error)
+		want    Money
+		wantErr bool
+	}{
+		{"add", func() (Money, error) { return ron(150).Add(ron(275)) }, ron(425), false},
+		{"sub below zero", func() (Money, error) { return ron(150).Sub(ron(275)) }, ron(-125), false},
+		{"add to empty", func() (Money, error) { return Money{}.Add(Money{100, CurrencyEUR}) }, Money{100, CurrencyEUR}, false},
+		{"add mismatch", func() (Money, error) { return ron(100).Add(Money{100, CurrencyEUR}) }, Money{}, true},
+		{"quantity", func() (Money, error) { return ron(199).MulQuantity(3) }, ron(597), false},
+		{"float quantity", func() (Money, error) { return ron(1000).MulQuantity(32.3) }, ron(32300), false},
+		{"quantity rounds", func() (Money, error) { return ron(333).MulQuantity(0.5) }, ron(167), false},
+		{"prorate", func() (Money, error) { return ron(1000).Prorate(1, 3) }, ron(333), false},
+		{"prorate all", func() (Money, error) { return ron(1000).Prorate(3, 3) }, ron(1000), false},
+		{"prorate by zero", func() (Money, error) { return ron(1000).Prorate(1, 0) }, Money{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.op()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMoneyCmp(t *testing.T) {
+	if c, err := NewMoney(100, "").Cmp(NewMoney(99, CurrencyRON)); err != nil || c != 1 {
+		t.Errorf("Cmp = %d, %v, want 1", c, err)
+	}
+	if _, err := NewMoney(100, CurrencyRON).Cmp(NewMoney(100, CurrencyUSD)); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Errorf("Cmp across currencies error = %v, want %v", err, ErrCurrencyMismatch)
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Money
+	}{
+		{`{"amount":"12.34","currency":"EUR"}`, Money{1234, CurrencyEUR}},
+		{`{"amount":12.34}`, Money{1234, CurrencyRON}},
+		{`12.345`, Money{1235, CurrencyRON}},
+		{`"7"`, Money{700, CurrencyRON}},
+		{`null`, Money{}},
+	}
+
+	for _, tt := range tests {
+		var got Money
+		if err := json.Unmarshal([]byte(tt.in), &got); err != nil {
+			t.Errorf("Unmarshal(%s): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Unmarshal(%s) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+
+	out, err := json.Marshal(Money{-1234, CurrencyEUR})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != `{"amount":"-12.34","currency":"EUR"}` {
+		t.Errorf("Marshal = %s", out)
+	}
+}
+
+func TestMoneyBSON(t *testing.T) {
+	type doc struct {
+		Price Money `bson:"price"`
+	}
+
+	for _, want := range []Money{{1234, CurrencyEUR}, {-1, CurrencyRON}, {1234, "JPY"}} {
+		data, err := bson.Marshal(doc{want})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got doc
+		if err := bson.Unmarshal(data, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Price != want {
+			t.Errorf("round trip of %+v = %+v", want, got.Price)
+		}
+	}
+
+	// amounts stored as floats before Money are read in the default currency
+	legacy := []interface{}{34.23, int32(5), int64(-7)}
+	wants := []Money{{3423, CurrencyRON}, {500, CurrencyRON}, {-700, CurrencyRON}}
+	for i, value := range legacy {
+		data, err := bson.Marshal(bson.M{"price": value})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got doc
+		if err := bson.Unmarshal(data, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Price != wants[i] {
+			t.Errorf("legacy %v = %+v, want %+v", value, got.Price, wants[i])
+		}
+	}
+}
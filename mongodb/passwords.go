@@ -0,0 +1,105 @@
+package mongodb
+
+import (
+	"context"
+	"crypto/subtle"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"time"
+)
+
+var PasswordCost = 12
+
+// bcrypt only takes up to 72 bytes
+const (
+	MinPasswordLength = 8
+	MaxPasswordLength = 72
+)
+
+// checkPassword tells whether a new password can be set.
+func checkPassword(password string) error {
+	if len(password) < MinPasswordLength {
+		return ErrWeakPassword
+	}
+	if len(password) > MaxPasswordLength {
+		return ErrPasswordTooLong
+	}
+	return nil
+}
+
+// compared against when the user does not exist, so a missing username costs
+// as much time as a wrong password
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), PasswordCost)
+
+// HashPassword returns a bcrypt hash; bcrypt generates a fresh salt per call.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), PasswordCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func isPasswordHash(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+}
+
+// verifyPassword reports whether password matches the stored value and whether
+// the stored value should be replaced: legacy plaintext records and hashes made
+// with a lower cost are upgraded on the next successful login.
+func verifyPassword(stored string, password string) (bool, bool) {
+	if !isPasswordHash(stored) {
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1, true
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)); err != nil {
+		return false, false
+	}
+
+	cost, err := bcrypt.Cost([]byte(stored))
+	return true, err != nil || cost < PasswordCost
+}
+
+func SetPassword(username string, password string) error {
+	if err := checkPassword(password); err != nil {
+		return err
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Users)
+
+	result, err := collection.UpdateOne(ctx, bson.M{"username": username}, bson.M{"$set": bson.M{"password": hash}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+// rehashPassword stores a fresh hash of a password that was just verified. It
+// skips the length check so legacy short passwords can still be upgraded.
+func rehashPassword(username string, password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Users)
+
+	if _, err := collection.UpdateOne(ctx, bson.M{"username": username}, bson.M{"$set": bson.M{"password": hash}}); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,24 @@
+package mongodb
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckPassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		wantErr  error
+	}{
+		{"shortest", strings.Repeat("x", MinPasswordLength), nil},
+		{"longest", strings.Repeat("x", MaxPasswordLength), nil},
+		{"too short", strings.Repeat("x", MinPasswordLength-1), ErrWeakPassword},
+		{"too long for bcrypt", strings.Repeat("x", MaxPasswordLength+1), ErrPasswordTooLong},
+		{"multibyte over the limit", strings.Repeat("ă", 37), ErrPasswordTooLong},
+	}
+
+	for _, tt := range tests {
+		testError(t, tt.name, checkPassword(tt.password), tt.wantErr)
+	}
+}
@@ -0,0 +1,265 @@
+package mongodb
+
+import (
+	"encoding/json"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"strings"
+	"time"
+)
+
+func (t TenderType) Valid() bool {
+	switch t {
+	case TenderAccount, TenderCash, TenderCard, TenderVoucher:
+		return true
+	}
+	return false
+}
+
+// maskReference hides all but the last four characters of a voucher code, which
+// is as good as cash to whoever reads it. Card authorization codes are shown.
+func maskReference(method TenderType, reference string) string {
+	if method != TenderVoucher || reference == "" {
+		return reference
+	}
+	if len(reference) <= 4 {
+		return "****"
+	}
+	return "****" + reference[len(reference)-4:]
+}
+
+// MarshalJSON answers a payment with its voucher code masked; the database
+// keeps the whole code.
+func (p Payment) MarshalJSON() ([]byte, error) {
+	type payment Payment
+	p.Reference = maskReference(p.Method, p.Reference)
+	return json.Marshal(payment(p))
+}
+
+func (r TenderRefund) MarshalJSON() ([]byte, error) {
+	type tenderRefund TenderRefund
+	r.Reference = maskReference(r.Method, r.Reference)
+	return json.Marshal(tenderRefund(r))
+}
+
+// Due is what is left to pay on a receipt.
+func (r Receipt) Due() (Money, error) {
+	return r.TotalPrice.Sub(r.Paid)
+}
+
+// tender fills in Amount, Tendered and Change of a payment towards due. Cash
+// may be more than is due and gets change; any other tender may not, and
+// without an amount it pays all that is due.
+func tender(payment Payment, due Money) (Payment, error) {
+	switch payment.Method {
+	case TenderCash:
+		if payment.Tendered.IsZero() {
+			payment.Tendered = payment.Amount
+		}
+		if payment.Tendered.Amount <= 0 {
+			return Payment{}, ErrInvalidAmount
+		}
+		payment.Amount = payment.Tendered
+		if c, err := payment.Tendered.Cmp(due); err != nil {
+			return Payment{}, err
+		} else if c > 0 {
+			payment.Amount = due
+		}
+		change, err := payment.Tendered.Sub(payment.Amount)
+		if err != nil {
+			return Payment{}, err
+		}
+		payment.Change = change
+	default:
+		if payment.Amount.IsZero() {
+			payment.Amount = due
+		}
+		if payment.Amount.Amount <= 0 {
+			return Payment{}, ErrInvalidAmount
+		}
+		if c, err := payment.Amount.Cmp(due); err != nil {
+			return Payment{}, err
+		} else if c > 0 {
+			return Payment{}, fmt.Errorf("%w: %s due", ErrOverpayment, due)
+		}
+		payment.Tendered = Money{}
+		payment.Change = Money{}
+	}
+
+	return payment, nil
+}
+
+// PayReceipt takes one payment towards an open receipt. Account payments are
+// made by a buyer from their own account, every other tender is taken by the
+// seller at the till. A voucher pays from the balance of an issued voucher and
+// a card authorization code pays for one receipt only. Account and voucher
+// payments are credited to the seller right away, cash and card go to the
+// seller's till until they are settled; the receipt closes, and its stock is
+// sold, with the payment that covers the rest of TotalPrice.
+func PayReceipt(session Session, id int, payment Payment) (Receipt, error) {
+	if !payment.Method.Valid() {
+		return Receipt{}, ErrInvalidTender
+	}
+	payment.Reference = strings.TrimSpace(payment.Reference)
+	if payment.Method == TenderVoucher && payment.Reference == "" {
+		return Receipt{}, fmt.Errorf("%w: a voucher needs its code as reference", ErrInvalidTender)
+	}
+	if payment.Method == TenderCard && payment.Reference == "" {
+		return Receipt{}, fmt.Errorf("%w: a card payment needs its authorization code as reference", ErrInvalidTender)
+	}
+
+	var receipt Receipt
+	err := RunTransaction(func(sessCtx mongo.SessionContext) error {
+		var err error
+		if receipt, err = getReceipt(sessCtx, id); err != nil {
+			return err
+		}
+		if receipt.Status != ReceiptStatusOpened {
+			return ErrReceiptNotOpen
+		}
+		if receipt.Expired(time.Now()) {
+			return ErrReceiptExpired
+		}
+
+		if payment.Method == TenderAccount {
+			if session.Profile != ProfileTypeBuyer {
+				return ErrForbidden
+			}
+			if receipt.Buyer != "" && receipt.Buyer != session.Username {
+				return fmt.Errorf("%w: receipt is being paid by %s", ErrPartyMismatch, receipt.Buyer)
+			}
+		} else if session.Username != receipt.Seller {
+			return ErrForbidden
+		}
+
+		var due Money
+		if due, err = receipt.Due(); err != nil {
+			return err
+		}
+		if payment, err = tender(payment, due); err != nil {
+			return err
+		}
+		payment.Payer = session.Username
+		payment.At = time.Now()
+
+		switch payment.Method {
+		case TenderVoucher:
+			payment.Reference = normalizeCoupon(payment.Reference)
+			if err := redeemVoucher(sessCtx, payment.Reference, payment.Amount); err != nil {
+				return err
+			}
+		case TenderCard:
+			if err := claimReference(sessCtx, TenderCard, payment.Reference, receipt.Id); err != nil {
+				return err
+			}
+		}
+
+		var seller User
+		var sellerAccount Account
+		if seller, err = getUser(sessCtx, receipt.Seller); err != nil {
+			return err
+		}
+		if sellerAccount, err = getAccount(sessCtx, seller.AccountId); err != nil {
+			return err
+		}
+
+		entry := LedgerEntry{
+			Kind:      LedgerSale,
+			Receipt:   receipt.Id,
+			Memo:      string(payment.Method),
+			CreatedBy: session.Username,
+		}
+
+		if payment.Method == TenderAccount {
+			var buyer User
+			var buyerAccount Account
+			if buyer, err = getUser(sessCtx, session.Username); err != nil {
+				return err
+			}
+			if buyerAccount, err = getAccount(sessCtx, buyer.AccountId); err != nil {
+				return err
+			}
+
+			var debit Money
+			if debit, err = convertForAccount(sessCtx, &receipt, buyerAccount, payment.Amount); err != nil {
+				return err
+			}
+			if err := UpdateAccount(sessCtx, buyerAccount.Id, debit.Neg()); err != nil {
+				return err
+			}
+			receipt.Buyer = session.Username
+			entry.Postings = append(entry.Postings, Posting{Account: buyerAccount.Id, Amount: debit.Neg()})
+		} else {
+			entry.Postings = append(entry.Postings, Posting{Account: tenderAccount(payment.Method), Amount: payment.Amount.Neg()})
+		}
+
+		switch payment.Method {
+		case TenderCash, TenderCard:
+			// only the seller vouches for these, so they wait in the till
+			payment.Till = true
+			entry.Postings = append(entry.Postings, Posting{Account: tillAccount(receipt.Seller), Amount: payment.Amount})
+		default:
+			var credit Money
+			if credit, err = convertForAccount(sessCtx, &receipt, sellerAccount, payment.Amount); err != nil {
+				return err
+			}
+			if err := UpdateAccount(sessCtx, sellerAccount.Id, credit); err != nil {
+				return err
+			}
+			entry.Postings = append(entry.Postings, Posting{Account: sellerAccount.Id, Amount: credit})
+		}
+		if err := recordEntry(sessCtx, &entry); err != nil {
+			return err
+		}
+
+		receipt.Payments = append(receipt.Payments, payment)
+		if receipt.Paid, err = receipt.Paid.Add(payment.Amount); err != nil {
+			return err
+		}
+
+		if due, err = receipt.Due(); err != nil {
+			return err
+		}
+		if due.Amount <= 0 {
+			now := time.Now()
+			receipt.ConfirmedAt = &now
+			if err := redeemCoupons(sessCtx, receipt); err != nil {
+				return err
+			}
+			if err := UpdateReceipt(sessCtx, receipt); err != nil {
+				return err
+			}
+			receipt.Status = ReceiptStatusClosed
+			return nil
+		}
+
+		filter := bson.M{"id": receipt.Id, "status": ReceiptStatusOpened}
+		update := bson.M{"$set": bson.M{
+			"buyer":       receipt.Buyer,
+			"payments":    receipt.Payments,
+			"paid":        receipt.Paid,
+			"conversions": receipt.Conversions,
+		}}
+		db := Client.Database(MyDb.DbName)
+
+		if result, err := db.Collection(MyDb.Receipts).UpdateOne(sessCtx, filter, update); err != nil {
+			return err
+		} else if result.MatchedCount == 0 {
+			return ErrReceiptNotOpen
+		}
+
+		// the stock stays held until the rest is paid
+		update = bson.M{"$unset": bson.M{"expires_at": ""}}
+		if _, err := db.Collection(MyDb.Reservations).UpdateOne(sessCtx, bson.M{"receipt": receipt.Id}, update); err != nil {
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		return Receipt{}, err
+	}
+
+	return receipt, nil
+}
@@ -0,0 +1,111 @@
+package mongodb
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestTender(t *testing.T) {
+	tests := []struct {
+		name    string
+		payment Payment
+		due     Money
+		want    Payment
+		wantErr error
+	}{
+		{
+			name:    "cash with change",
+			payment: Payment{Method: TenderCash, Tendered: ron(5000)},
+			due:     ron(3250),
+			want:    Payment{Method: TenderCash, Amount: ron(3250), Tendered: ron(5000), Change: ron(1750)},
+		},
+		{
+			name:    "cash short of due",
+			payment: Payment{Method: TenderCash, Amount: ron(1000)},
+			due:     ron(3250),
+			want:    Payment{Method: TenderCash, Amount: ron(1000), Tendered: ron(1000), Change: ron(0)},
+		},
+		{
+			name:    "card pays all due",
+			payment: Payment{Method: TenderCard, Reference: "A1"},
+			due:     ron(3250),
+			want:    Payment{Method: TenderCard, Amount: ron(3250), Reference: "A1"},
+		},
+		{
+			name:    "voucher pays part",
+			payment: Payment{Method: TenderVoucher, Amount: ron(2000), Tendered: ron(9999)},
+			due:     ron(3250),
+			want:    Payment{Method: TenderVoucher, Amount: ron(2000)},
+		},
+		{
+			name:    "account over due",
+			payment: Payment{Method: TenderAccount, Amount: ron(4000)},
+			due:     ron(3250),
+			wantErr: ErrOverpayment,
+		},
+		{
+			name:    "negative amount",
+			payment: Payment{Method: TenderCard, Amount: ron(-1)},
+			due:     ron(3250),
+			wantErr: ErrInvalidAmount,
+		},
+		{
+			name:    "cash without an amount",
+			payment: Payment{Method: TenderCash},
+			due:     ron(3250),
+			wantErr: ErrInvalidAmount,
+		},
+		{
+			name:    "other currency",
+			payment: Payment{Method: TenderCard, Amount: Money{100, CurrencyEUR}},
+			due:     ron(3250),
+			wantErr: ErrCurrencyMismatch,
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := tender(tt.payment, tt.due)
+		if testError(t, tt.name, err, tt.wantErr) {
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPaymentMarshalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		payment Payment
+		want    string
+	}{
+		{"voucher", Payment{Method: TenderVoucher, Reference: "GIFT-0001"}, "****0001"},
+		{"short voucher", Payment{Method: TenderVoucher, Reference: "AB12"}, "****"},
+		{"card", Payment{Method: TenderCard, Reference: "AUTH123456"}, "AUTH123456"},
+	}
+	for _, tt := range tests {
+		data, err := json.Marshal(tt.payment)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var got struct {
+			Reference string `json:"reference"`
+		}
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got.Reference != tt.want {
+			t.Errorf("%s: reference = %q, want %q", tt.name, got.Reference, tt.want)
+		}
+	}
+
+	data, err := json.Marshal(TenderRefund{Method: TenderVoucher, Reference: "GIFT-0001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "GIFT-0001") {
+		t.Errorf("refund tender shows the voucher code: %s", data)
+	}
+}
@@ -0,0 +1,450 @@
+package mongodb
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// PriceAt is the price in effect at t. When overrides overlap the one added
+// last wins.
+func (p Product) PriceAt(t time.Time) Money {
+	price := p.Price
+	for _, override := range p.PriceOverrides {
+		if !t.Before(override.StartsAt) && t.Before(override.EndsAt) {
+			price = override.Price
+		}
+	}
+	return price
+}
+
+// AddPriceOverride schedules a temporary price for a product.
+func AddPriceOverride(productId string, override PriceOverride) error {
+	if override.Price.IsNegative() || !override.EndsAt.After(override.StartsAt) {
+		return ErrInvalidPromotion
+	}
+
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Products)
+
+	filter := bson.M{"id": productId}
+	update := bson.M{"$push": bson.M{"price_overrides": override}}
+
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+func normalizeCoupon(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func normalizeCoupons(codes []string) []string {
+	var normalized []string
+	seen := map[string]bool{}
+
+	for _, code := range codes {
+		code = normalizeCoupon(code)
+		if code == "" || seen[code] {
+			continue
+		}
+		seen[code] = true
+		normalized = append(normalized, code)
+	}
+
+	return normalized
+}
+
+func (p Promotion) validate() error {
+	if p.Id == "" {
+		return fmt.Errorf("%w: missing id", ErrInvalidPromotion)
+	}
+	if p.StartsAt != nil && p.EndsAt != nil && !p.EndsAt.After(*p.StartsAt) {
+		return fmt.Errorf("%w: ends before it starts", ErrInvalidPromotion)
+	}
+	if p.UsageLimit < 0 {
+		return fmt.Errorf("%w: negative usage limit", ErrInvalidPromotion)
+	}
+
+	switch p.Kind {
+	case PromotionPercent:
+		if p.BasisPoints <= 0 || p.BasisPoints > 10000 {
+			return fmt.Errorf("%w: basis_points must be 1-10000", ErrInvalidPromotion)
+		}
+	case PromotionFixed:
+		if p.Amount.Amount <= 0 {
+			return fmt.Errorf("%w: amount must be positive", ErrInvalidPromotion)
+		}
+	case PromotionBuyXGetY:
+		if p.Product == "" || p.Buy <= 0 || p.Get <= 0 {
+			return fmt.Errorf("%w: needs a product, buy and get", ErrInvalidPromotion)
+		}
+	case PromotionMultiBuy:
+		if p.Product == "" || p.Buy <= 1 || p.Amount.Amount <= 0 {
+			return fmt.Errorf("%w: needs a product, buy > 1 and an amount", ErrInvalidPromotion)
+		}
+	default:
+		return fmt.Errorf("%w: unknown kind %q", ErrInvalidPromotion, p.Kind)
+	}
+
+	return nil
+}
+
+func (p Promotion) exhausted() bool {
+	return p.UsageLimit > 0 && p.Used >= p.UsageLimit
+}
+
+func AddPromotion(promotion Promotion) error {
+	promotion.Coupon = normalizeCoupon(promotion.Coupon)
+	promotion.Used = 0
+	if err := promotion.validate(); err != nil {
+		return err
+	}
+
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Promotions)
+
+	if _, err := collection.InsertOne(ctx, promotion); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("%w: id %s is taken", ErrInvalidPromotion, promotion.Id)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// activePromotions loads the promotions running at now, in id order. Coupon
+// promotions are only included for the codes given, and every code has to
+// match at least one of them.
+func activePromotions(ctx context.Context, now time.Time, coupons []string) ([]Promotion, error) {
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Promotions)
+
+	filter := bson.M{"$and": bson.A{
+		bson.M{"$or": bson.A{bson.M{"starts_at": nil}, bson.M{"starts_at": bson.M{"$lte": now}}}},
+		bson.M{"$or": bson.A{bson.M{"ends_at": nil}, bson.M{"ends_at": bson.M{"$gt": now}}}},
+	}}
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.M{"id": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	var all []Promotion
+	if err = cursor.All(ctx, &all); err != nil {
+		return nil, err
+	}
+
+	found := map[string]error{}
+	for _, code := range coupons {
+		found[code] = ErrInvalidCoupon
+	}
+
+	var active []Promotion
+	for _, promotion := range all {
+		if promotion.Coupon != "" {
+			if _, ok := found[promotion.Coupon]; !ok {
+				continue
+			}
+			if promotion.exhausted() {
+				if found[promotion.Coupon] != nil {
+					found[promotion.Coupon] = ErrCouponExhausted
+				}
+				continue
+			}
+			found[promotion.Coupon] = nil
+		}
+		active = append(active, promotion)
+	}
+
+	for _, code := range coupons {
+		if err := found[code]; err != nil {
+			return nil, fmt.Errorf("%w: %s", err, code)
+		}
+	}
+
+	return active, nil
+}
+
+// PriceReceipt applies the promotions running at now to the lines of receipt
+// and sets Subtotal, Discount, Promotions, the tax breakdown and TotalPrice.
+func PriceReceipt(ctx context.Context, receipt *Receipt, now time.Time) error {
+	promotions, err := activePromotions(ctx, now, receipt.Coupons)
+	if err != nil {
+		return err
+	}
+	if err = applyPromotions(receipt, promotions); err != nil {
+		return err
+	}
+	return applyTaxes(receipt)
+}
+
+// applyPromotions gives every line the best of the promotions on its product,
+// then takes the receipt promotions off what is left, one after the other.
+// A receipt discount is spread over the lines by their totals, so LineTotal
+// always is what the customer paid for the line.
+func applyPromotions(receipt *Receipt, promotions []Promotion) error {
+	var err error
+	receipt.Subtotal = Money{}
+	receipt.Discount = Money{}
+	receipt.Promotions = nil
+
+	for i := range receipt.Products {
+		line := &receipt.Products[i]
+
+		var gross Money
+		if gross, err = line.UnitPrice.MulQuantity(line.Quantity); err != nil {
+			return err
+		}
+		if receipt.Subtotal, err = receipt.Subtotal.Add(gross); err != nil {
+			return err
+		}
+
+		line.Discount = Money{Currency: gross.Currency}
+		best := -1
+		for j, promotion := range promotions {
+			if promotion.Product == "" || promotion.Product != line.Id {
+				continue
+			}
+			var discount Money
+			if discount, err = lineDiscount(promotion, *line, gross); err != nil {
+				return err
+			}
+			if discount.Amount > line.Discount.Amount {
+				line.Discount = discount
+				best = j
+			}
+		}
+
+		if best >= 0 {
+			receipt.Promotions = append(receipt.Promotions, AppliedPromotion{
+				Id:     promotions[best].Id,
+				Name:   promotions[best].Name,
+				Kind:   promotions[best].Kind,
+				Coupon: promotions[best].Coupon,
+				Line:   i,
+				Amount: line.Discount,
+			})
+		}
+		if line.LineTotal, err = gross.Sub(line.Discount); err != nil {
+			return err
+		}
+	}
+
+	for _, promotion := range promotions {
+		if promotion.Product != "" {
+			continue
+		}
+
+		var total Money
+		if total, err = CalculateTotalPrice(receipt.Products); err != nil {
+			return err
+		}
+		var discount Money
+		if discount, err = receiptDiscount(promotion, total); err != nil {
+			return err
+		}
+		if discount.Amount <= 0 {
+			continue
+		}
+		if err = spreadDiscount(receipt.Products, discount, total); err != nil {
+			return err
+		}
+
+		receipt.Promotions = append(receipt.Promotions, AppliedPromotion{
+			Id:     promotion.Id,
+			Name:   promotion.Name,
+			Kind:   promotion.Kind,
+			Coupon: promotion.Coupon,
+			Line:   -1,
+			Amount: discount,
+		})
+	}
+
+	for _, line := range receipt.Products {
+		if receipt.Discount, err = receipt.Discount.Add(line.Discount); err != nil {
+			return err
+		}
+	}
+	receipt.TotalPrice, err = CalculateTotalPrice(receipt.Products)
+	return err
+}
+
+func percentOf(m Money, basisPoints int) (Money, error) {
+	return moneyFromRat(new(big.Rat).Mul(m.Rat(), big.NewRat(int64(basisPoints), 10000)), m.Currency)
+}
+
+// sameCurrency tells whether a promotion amount can be used on a price;
+// promotions in another currency simply do not apply.
+func sameCurrency(amount Money, price Money) bool {
+	return amount.Currency.orDefault() == price.Currency.orDefault()
+}
+
+func lineDiscount(promotion Promotion, line ReceiptProduct, gross Money) (Money, error) {
+	none := Money{Currency: gross.Currency}
+
+	switch promotion.Kind {
+	case PromotionPercent:
+		return percentOf(gross, promotion.BasisPoints)
+	case PromotionFixed:
+		if !sameCurrency(promotion.Amount, gross) {
+			return none, nil
+		}
+		if promotion.Amount.Amount > gross.Amount {
+			return gross, nil
+		}
+		return promotion.Amount, nil
+	case PromotionBuyXGetY:
+		// only whole units count, 2.5 kg is not a third kilogram
+		free := int(line.Quantity) / (promotion.Buy + promotion.Get) * promotion.Get
+		return line.UnitPrice.MulQuantity(float32(free))
+	case PromotionMultiBuy:
+		groups := int(line.Quantity) / promotion.Buy
+		if groups == 0 || !sameCurrency(promotion.Amount, gross) {
+			return none, nil
+		}
+		normal, err := line.UnitPrice.MulQuantity(float32(groups * promotion.Buy))
+		if err != nil {
+			return Money{}, err
+		}
+		deal := Money{Amount: promotion.Amount.Amount * int64(groups), Currency: promotion.Amount.Currency}
+		discount, err := normal.Sub(deal)
+		if err != nil || discount.IsNegative() {
+			return none, err
+		}
+		return discount, nil
+	}
+
+	return none, nil
+}
+
+func receiptDiscount(promotion Promotion, total Money) (Money, error) {
+	switch promotion.Kind {
+	case PromotionPercent:
+		return percentOf(total, promotion.BasisPoints)
+	case PromotionFixed:
+		if !sameCurrency(promotion.Amount, total) {
+			return Money{Currency: total.Currency}, nil
+		}
+		if promotion.Amount.Amount > total.Amount {
+			return total, nil
+		}
+		return promotion.Amount, nil
+	}
+
+	return Money{Currency: total.Currency}, nil
+}
+
+// spreadDiscount takes discount off the lines in proportion to their totals;
+// the last line takes the rounding remainder.
+func spreadDiscount(lines []ReceiptProduct, discount Money, total Money) error {
+	if total.Amount <= 0 {
+		return nil
+	}
+
+	last := -1
+	for i, line := range lines {
+		if line.LineTotal.Amount > 0 {
+			last = i
+		}
+	}
+
+	left := discount
+	for i := range lines {
+		line := &lines[i]
+		if line.LineTotal.Amount <= 0 {
+			continue
+		}
+
+		share := left
+		if i != last {
+			var err error
+			ratio := new(big.Rat).Mul(discount.Rat(), big.NewRat(line.LineTotal.Amount, total.Amount))
+			if share, err = moneyFromRat(ratio, discount.Currency); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		if left, err = left.Sub(share); err != nil {
+			return err
+		}
+		if line.Discount, err = line.Discount.Add(share); err != nil {
+			return err
+		}
+		if line.LineTotal, err = line.LineTotal.Sub(share); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// redeemCoupons counts one use of every coupon promotion applied to receipt.
+// It fails with ErrCouponExhausted if another receipt used up the last one.
+func redeemCoupons(ctx context.Context, receipt Receipt) error {
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Promotions)
+	redeemed := map[string]bool{}
+
+	for _, applied := range receipt.Promotions {
+		if applied.Coupon == "" || redeemed[applied.Id] {
+			continue
+		}
+		redeemed[applied.Id] = true
+
+		filter := bson.M{"id": applied.Id, "$or": bson.A{
+			bson.M{"usage_limit": bson.M{"$exists": false}},
+			bson.M{"$expr": bson.M{"$lt": bson.A{"$used", "$usage_limit"}}},
+		}}
+		update := bson.M{"$inc": bson.M{"used": 1}}
+
+		result, err := collection.UpdateOne(ctx, filter, update)
+		if err != nil {
+			return err
+		}
+		if result.MatchedCount == 0 {
+			return fmt.Errorf("%w: %s", ErrCouponExhausted, applied.Coupon)
+		}
+	}
+
+	return nil
+}
+
+// ApplyCoupon adds a coupon code to an open receipt of the caller and prices
+// the receipt again.
+func ApplyCoupon(session Session, id int, code string) (Receipt, error) {
+	code = normalizeCoupon(code)
+	if code == "" {
+		return Receipt{}, ErrInvalidCoupon
+	}
+
+	var receipt Receipt
+	err := RunTransaction(func(sessCtx mongo.SessionContext) error {
+		var err error
+		if receipt, err = openReceiptOf(sessCtx, session, id); err != nil {
+			return err
+		}
+
+		receipt.Coupons = normalizeCoupons(append(receipt.Coupons, code))
+		if err = PriceReceipt(sessCtx, &receipt, time.Now()); err != nil {
+			return err
+		}
+
+		return storeOpenReceipt(sessCtx, &receipt)
+	})
+	if err != nil {
+		return Receipt{}, err
+	}
+
+	return receipt, nil
+}
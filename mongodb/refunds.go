@@ -0,0 +1,328 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"time"
+)
+
+// float32 quantities such as 32.3 - 10.1 do not subtract exactly
+const quantityEpsilon = 1e-4
+
+// returnLots spreads quantity over the lots it was sold from, newest
+// allocation first, marking it Returned, and tells how much goes back into
+// each lot. What the allocations do not cover goes into lastLot.
+func returnLots(lots []LotAllocation, quantity float32, lastLot int) map[int]float32 {
+	back := map[int]float32{}
+	remaining := quantity
+	for i := len(lots) - 1; i >= 0 && remaining > 0; i-- {
+		free := lots[i].Quantity - lots[i].Returned
+		if free <= 0 {
+			continue
+		}
+		if free > remaining {
+			free = remaining
+		}
+		lots[i].Returned += free
+		back[lots[i].Lot] += free
+		remaining -= free
+	}
+	if remaining > 0 {
+		back[lastLot] += remaining
+	}
+	return back
+}
+
+// restoreStock puts quantity back into the lots it was sold from, newest
+// allocation first, and returns the allocations with Returned updated.
+// Receipts confirmed before lots were recorded restock the newest lot.
+func restoreStock(ctx context.Context, id string, lots []LotAllocation, quantity float32) ([]LotAllocation, error) {
+	var product Product
+	var err error
+	if product, err = getProduct(ctx, id); err != nil {
+		return nil, err
+	}
+	if len(product.Stocks) == 0 {
+		return nil, fmt.Errorf("product %s has no stock lots", id)
+	}
+
+	back := returnLots(lots, quantity, len(product.Stocks)-1)
+
+	set := bson.M{}
+	inc := bson.M{"total_available": quantity, "total_sold": -quantity}
+	for lot, q := range back {
+		if lot >= len(product.Stocks) {
+			return nil, fmt.Errorf("product %s has no stock lot %d", id, lot)
+		}
+		inc[fmt.Sprintf("stocks.%d.total_available", lot)] = q
+		inc[fmt.Sprintf("stocks.%d.total_sold", lot)] = -q
+		set[fmt.Sprintf("stocks.%d.status", lot)] = ProductStatusAvailable
+	}
+
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Products)
+	if _, err := collection.UpdateOne(ctx, bson.M{"id": id}, bson.M{"$inc": inc, "$set": set}); err != nil {
+		return nil, err
+	}
+
+	return lots, nil
+}
+
+// refundAmount checks that quantity of a receipt line can still be refunded
+// and prices it. A quantity within rounding of what is left is taken as all of
+// it, and the last units take whatever is left of the line total, so rounding
+// never refunds more or less than was paid.
+func refundAmount(sold ReceiptProduct, quantity float32) (float32, Money, error) {
+	left := sold.Quantity - sold.Refunded
+	if quantity > left+quantityEpsilon {
+		return 0, Money{}, fmt.Errorf("%w: %v left", ErrRefundTooLarge, left)
+	}
+	if quantity > left-quantityEpsilon {
+		quantity = left
+	}
+
+	var amount Money
+	var err error
+	if quantity == left {
+		amount, err = sold.LineTotal.Sub(sold.RefundedAmount)
+	} else {
+		amount, err = sold.LineTotal.Prorate(quantity, sold.Quantity)
+	}
+	if err != nil {
+		return 0, Money{}, err
+	}
+	return quantity, amount, nil
+}
+
+// splitRefund shares total out over the payments of a receipt, newest payment
+// first, none getting back more than it paid less what was refunded to it
+// before; Refunded of the payments is updated. Receipts closed before payments
+// were recorded were paid in full from the buyer's account, or in cash when
+// there is no buyer.
+func splitRefund(receipt *Receipt, total Money) ([]TenderRefund, error) {
+	if len(receipt.Payments) == 0 {
+		method := TenderCash
+		if receipt.Buyer != "" {
+			method = TenderAccount
+		}
+		return []TenderRefund{{Payment: -1, Method: method, Payer: receipt.Buyer, Amount: total}}, nil
+	}
+
+	var parts []TenderRefund
+	remaining := total
+	for i := len(receipt.Payments) - 1; i >= 0 && remaining.Amount > 0; i-- {
+		payment := &receipt.Payments[i]
+		free, err := payment.Amount.Sub(payment.Refunded)
+		if err != nil {
+			return nil, err
+		}
+		if free.Amount <= 0 {
+			continue
+		}
+		if c, err := free.Cmp(remaining); err != nil {
+			return nil, err
+		} else if c > 0 {
+			free = remaining
+		}
+
+		if payment.Refunded, err = payment.Refunded.Add(free); err != nil {
+			return nil, err
+		}
+		if remaining, err = remaining.Sub(free); err != nil {
+			return nil, err
+		}
+		parts = append(parts, TenderRefund{
+			Payment:   i,
+			Method:    payment.Method,
+			Reference: payment.Reference,
+			Payer:     payment.Payer,
+			Amount:    free,
+		})
+	}
+	if remaining.Amount > 0 {
+		return nil, fmt.Errorf("%w: %s more than was paid", ErrRefundTooLarge, remaining)
+	}
+
+	return parts, nil
+}
+
+// takeBack debits every part of a refund from where its payment was credited:
+// the seller's till for cash and card taken into it, the seller's account at
+// the rate of the receipt for everything else.
+func takeBack(ctx context.Context, receipt Receipt, parts []TenderRefund, entry *LedgerEntry) error {
+	var fromAccount Money
+	for _, part := range parts {
+		if part.Payment >= 0 && receipt.Payments[part.Payment].Till {
+			entry.Postings = append(entry.Postings, Posting{Account: tillAccount(receipt.Seller), Amount: part.Amount.Neg()})
+			continue
+		}
+		var err error
+		if fromAccount, err = fromAccount.Add(part.Amount); err != nil {
+			return err
+		}
+	}
+	if fromAccount.IsZero() {
+		return nil
+	}
+
+	seller, err := getUser(ctx, receipt.Seller)
+	if err != nil {
+		return err
+	}
+	debit, err := receipt.recordedAmount(seller.AccountId, fromAccount)
+	if err != nil {
+		return err
+	}
+	if err := UpdateAccount(ctx, seller.AccountId, debit.Neg()); err != nil {
+		return err
+	}
+	entry.Postings = append(entry.Postings, Posting{Account: seller.AccountId, Amount: debit.Neg()})
+
+	return nil
+}
+
+// refundTenders gives every part back where it was paid from, adding the
+// postings to entry: account payments to the payer's account at the rate of
+// the receipt, vouchers back onto the voucher, cash and card through their
+// system accounts.
+func refundTenders(ctx context.Context, receipt Receipt, parts []TenderRefund, entry *LedgerEntry) error {
+	for _, part := range parts {
+		if part.Method != TenderAccount {
+			// vouchers taken before they were issued here have nothing to restore
+			if part.Method == TenderVoucher {
+				if err := restoreVoucher(ctx, part.Reference, part.Amount); err != nil && !errors.Is(err, ErrInvalidVoucher) {
+					return err
+				}
+			}
+			entry.Postings = append(entry.Postings, Posting{Account: tenderAccount(part.Method), Amount: part.Amount})
+			continue
+		}
+
+		payer, err := getUser(ctx, part.Payer)
+		if err != nil {
+			return err
+		}
+		credit, err := receipt.recordedAmount(payer.AccountId, part.Amount)
+		if err != nil {
+			return err
+		}
+		if err := UpdateAccount(ctx, payer.AccountId, credit); err != nil {
+			return err
+		}
+		entry.Postings = append(entry.Postings, Posting{Account: payer.AccountId, Amount: credit})
+	}
+
+	return nil
+}
+
+// RefundReceipt returns part or all of a closed receipt: the goods go back to
+// their stock lots and the money goes from the seller, or the seller's till,
+// back to the tenders the receipt was paid with, see splitRefund and takeBack. Only the seller of the receipt or a
+// manager can refund, and no line can be refunded beyond what was sold.
+func RefundReceipt(session Session, id int, lines []RefundLine, reason string) (Refund, error) {
+	if len(lines) == 0 {
+		return Refund{}, ErrInvalidQuantity
+	}
+	for _, line := range lines {
+		if line.Quantity <= 0 {
+			return Refund{}, ErrInvalidQuantity
+		}
+	}
+
+	// the refund number is taken in the transaction, so refunds that are
+	// refused leave no gap
+	var refund Refund
+	err := RunTransaction(func(sessCtx mongo.SessionContext) error {
+		var receipt Receipt
+		var err error
+
+		if receipt, err = getReceipt(sessCtx, id); err != nil {
+			return err
+		}
+		if receipt.Status != ReceiptStatusClosed {
+			return ErrReceiptNotClosed
+		}
+		if session.Profile != ProfileTypeManager && session.Username != receipt.Seller {
+			return ErrForbidden
+		}
+
+		refund.Receipt = receipt.Id
+		refund.Reason = reason
+		refund.CreatedBy = session.Username
+		refund.CreatedAt = time.Now()
+		refund.Lines = nil
+		refund.Total = Money{}
+
+		for _, line := range lines {
+			if line.Line < 0 || line.Line >= len(receipt.Products) {
+				return fmt.Errorf("%w: no line %d", ErrRefundTooLarge, line.Line)
+			}
+			sold := &receipt.Products[line.Line]
+			var amount Money
+			if line.Quantity, amount, err = refundAmount(*sold, line.Quantity); err != nil {
+				return fmt.Errorf("line %d: %w", line.Line, err)
+			}
+
+			if sold.Lots, err = restoreStock(sessCtx, sold.Id, sold.Lots, line.Quantity); err != nil {
+				return err
+			}
+			sold.Refunded += line.Quantity
+			if sold.RefundedAmount, err = sold.RefundedAmount.Add(amount); err != nil {
+				return err
+			}
+
+			refund.Lines = append(refund.Lines, RefundLine{
+				Line:     line.Line,
+				Id:       sold.Id,
+				Quantity: line.Quantity,
+				Amount:   amount,
+			})
+			if refund.Total, err = refund.Total.Add(amount); err != nil {
+				return err
+			}
+		}
+
+		if refund.Id, err = generateId(sessCtx, SequenceRefunds); err != nil {
+			return err
+		}
+		entry := LedgerEntry{
+			Kind:      LedgerRefund,
+			Receipt:   receipt.Id,
+			Refund:    refund.Id,
+			Memo:      reason,
+			CreatedBy: session.Username,
+		}
+
+		if refund.Tenders, err = splitRefund(&receipt, refund.Total); err != nil {
+			return err
+		}
+		if err := takeBack(sessCtx, receipt, refund.Tenders, &entry); err != nil {
+			return err
+		}
+		if err := refundTenders(sessCtx, receipt, refund.Tenders, &entry); err != nil {
+			return err
+		}
+		if err := recordEntry(sessCtx, &entry); err != nil {
+			return err
+		}
+
+		db := Client.Database(MyDb.DbName)
+		filter := bson.M{"id": receipt.Id, "status": ReceiptStatusClosed}
+		update := bson.M{"$set": bson.M{"products": receipt.Products, "payments": receipt.Payments}}
+		if _, err := db.Collection(MyDb.Receipts).UpdateOne(sessCtx, filter, update); err != nil {
+			return err
+		}
+		if _, err := db.Collection(MyDb.Refunds).InsertOne(sessCtx, refund); err != nil {
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		return Refund{}, err
+	}
+
+	return refund, nil
+}
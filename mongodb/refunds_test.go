@@ -0,0 +1,278 @@
+package mongodb
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRefundAmount(t *testing.T) {
+	tests := []struct {
+		name         string
+		sold         ReceiptProduct
+		quantity     float32
+		wantQuantity float32
+		want         Money
+	}{
+		{
+			name:         "part of a line",
+			sold:         ReceiptProduct{Quantity: 3, LineTotal: ron(1000)},
+			quantity:     1,
+			wantQuantity: 1,
+			want:         ron(333),
+		},
+		{
+			name:         "whole line",
+			sold:         ReceiptProduct{Quantity: 3, LineTotal: ron(1000)},
+			quantity:     3,
+			wantQuantity: 3,
+			want:         ron(1000),
+		},
+		{
+			name:         "last units take the rounding",
+			sold:         ReceiptProduct{Quantity: 3, LineTotal: ron(1000), Refunded: 2, RefundedAmount: ron(666)},
+			quantity:     1,
+			wantQuantity: 1,
+			want:         ron(334),
+		},
+		{
+			name:         "float quantity close to what is left",
+			sold:         ReceiptProduct{Quantity: 32.3, LineTotal: ron(32300), Refunded: 10.1, RefundedAmount: ron(10100)},
+			quantity:     22.20001,
+			wantQuantity: float32(32.3) - float32(10.1),
+			want:         ron(22200),
+		},
+	}
+
+	for _, tt := range tests {
+		quantity, amount, err := refundAmount(tt.sold, tt.quantity)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if quantity != tt.wantQuantity || amount != tt.want {
+			t.Errorf("%s = %v, %+v, want %v, %+v", tt.name, quantity, amount, tt.wantQuantity, tt.want)
+		}
+	}
+
+	sold := ReceiptProduct{Quantity: 3, LineTotal: ron(1000), Refunded: 2, RefundedAmount: ron(666)}
+	if _, _, err := refundAmount(sold, 2); !errors.Is(err, ErrRefundTooLarge) {
+		t.Errorf("more than is left: error = %v, want %v", err, ErrRefundTooLarge)
+	}
+}
+
+func TestReturnLots(t *testing.T) {
+	tests := []struct {
+		name     string
+		lots     []LotAllocation
+		quantity float32
+		lastLot  int
+		want     map[int]float32
+		wantLots []LotAllocation
+	}{
+		{
+			name:     "newest allocation first",
+			lots:     []LotAllocation{{Lot: 0, Quantity: 2}, {Lot: 1, Quantity: 3}},
+			quantity: 4,
+			lastLot:  1,
+			want:     map[int]float32{1: 3, 0: 1},
+			wantLots: []LotAllocation{{Lot: 0, Quantity: 2, Returned: 1}, {Lot: 1, Quantity: 3, Returned: 3}},
+		},
+		{
+			name:     "skips what was already returned",
+			lots:     []LotAllocation{{Lot: 0, Quantity: 2}, {Lot: 1, Quantity: 3, Returned: 3}},
+			quantity: 1,
+			lastLot:  1,
+			want:     map[int]float32{0: 1},
+			wantLots: []LotAllocation{{Lot: 0, Quantity: 2, Returned: 1}, {Lot: 1, Quantity: 3, Returned: 3}},
+		},
+		{
+			name:     "sales without lots restock the newest lot",
+			quantity: 2,
+			lastLot:  4,
+			want:     map[int]float32{4: 2},
+		},
+	}
+
+	for _, tt := range tests {
+		got := returnLots(tt.lots, tt.quantity, tt.lastLot)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s = %v, want %v", tt.name, got, tt.want)
+		}
+		if !reflect.DeepEqual(tt.lots, tt.wantLots) {
+			t.Errorf("%s: lots = %+v, want %+v", tt.name, tt.lots, tt.wantLots)
+		}
+	}
+}
+
+func TestSplitRefund(t *testing.T) {
+	paid := func(method TenderType, amount, refunded int64) Payment {
+		return Payment{Method: method, Amount: ron(amount), Refunded: ron(refunded), Payer: "p"}
+	}
+
+	tests := []struct {
+		name         string
+		receipt      Receipt
+		total        Money
+		want         []TenderRefund
+		wantRefunded []Money
+	}{
+		{
+			name:         "mixed tenders in full",
+			receipt:      Receipt{Payments: []Payment{paid(TenderAccount, 500, 0), paid(TenderCash, 9500, 0)}},
+			total:        ron(10000),
+			want:         []TenderRefund{{Payment: 1, Method: TenderCash, Payer: "p", Amount: ron(9500)}, {Payment: 0, Method: TenderAccount, Payer: "p", Amount: ron(500)}},
+			wantRefunded: []Money{ron(500), ron(9500)},
+		},
+		{
+			name:         "part goes to the newest payment",
+			receipt:      Receipt{Payments: []Payment{paid(TenderAccount, 500, 0), paid(TenderCard, 9500, 0)}},
+			total:        ron(3000),
+			want:         []TenderRefund{{Payment: 1, Method: TenderCard, Payer: "p", Amount: ron(3000)}},
+			wantRefunded: []Money{ron(0), ron(3000)},
+		},
+		{
+			name:         "continues after an earlier refund",
+			receipt:      Receipt{Payments: []Payment{paid(TenderAccount, 500, 0), paid(TenderVoucher, 9500, 9000)}},
+			total:        ron(1000),
+			want:         []TenderRefund{{Payment: 1, Method: TenderVoucher, Payer: "p", Amount: ron(500)}, {Payment: 0, Method: TenderAccount, Payer: "p", Amount: ron(500)}},
+			wantRefunded: []Money{ron(500), ron(9500)},
+		},
+		{
+			name:    "legacy receipt with a buyer",
+			receipt: Receipt{Buyer: "ion"},
+			total:   ron(700),
+			want:    []TenderRefund{{Payment: -1, Method: TenderAccount, Payer: "ion", Amount: ron(700)}},
+		},
+		{
+			name:    "legacy receipt without a buyer",
+			receipt: Receipt{},
+			total:   ron(700),
+			want:    []TenderRefund{{Payment: -1, Method: TenderCash, Amount: ron(700)}},
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := splitRefund(&tt.receipt, tt.total)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s = %+v, want %+v", tt.name, got, tt.want)
+		}
+		for i, want := range tt.wantRefunded {
+			if tt.receipt.Payments[i].Refunded != want {
+				t.Errorf("%s: payment %d refunded %+v, want %+v", tt.name, i, tt.receipt.Payments[i].Refunded, want)
+			}
+		}
+	}
+
+	receipt := Receipt{Payments: []Payment{paid(TenderCash, 500, 400)}}
+	if _, err := splitRefund(&receipt, ron(200)); !errors.Is(err, ErrRefundTooLarge) {
+		t.Errorf("more than was paid: error = %v, want %v", err, ErrRefundTooLarge)
+	}
+}
+
+// A receipt paid 5 from the buyer's account and 95 in cash gives back 5 to the
+// account and 95 in cash, never the whole 100 to the account.
+func TestRefundReceiptMixedTenders(t *testing.T) {
+	testDb(t)
+
+	sellerAccount := testUser(t, "seller1", ProfileTypeSeller, CurrencyRON)
+	buyerAccount := testUser(t, "buyer1", ProfileTypeBuyer, CurrencyRON)
+	testFund(t, sellerAccount, ron(500))
+
+	testInsert(t, MyDb.Products, Product{
+		Id:        "p1",
+		Name:      "apples",
+		Price:     ron(5000),
+		TotalSold: 2,
+		Stocks:    []ProductStock{{Id: "p1", TotalSold: 2, Status: ProductStatusSold}},
+	})
+	now := time.Now()
+	testInsert(t, MyDb.Receipts, Receipt{
+		Id:          1,
+		Seller:      "seller1",
+		Buyer:       "buyer1",
+		Status:      ReceiptStatusClosed,
+		CreatedAt:   now,
+		ConfirmedAt: &now,
+		Products: []ReceiptProduct{{
+			Id:        "p1",
+			Quantity:  2,
+			UnitPrice: ron(5000),
+			LineTotal: ron(10000),
+			Lots:      []LotAllocation{{Lot: 0, Quantity: 2}},
+		}},
+		TotalPrice: ron(10000),
+		Paid:       ron(10000),
+		Payments: []Payment{
+			{Method: TenderAccount, Amount: ron(500), Payer: "buyer1", At: now},
+			{Method: TenderCash, Amount: ron(9500), Tendered: ron(9500), Payer: "seller1", At: now, Till: true},
+		},
+	})
+
+	session := Session{Username: "seller1", Profile: ProfileTypeSeller}
+	steps := []struct {
+		want       []TenderRefund
+		wantBuyer  Money
+		wantSeller Money
+		wantTill   Money
+	}{
+		// the first unit comes out of the cash, the newest payment, which
+		// the till gives back
+		{
+			want:       []TenderRefund{{Payment: 1, Method: TenderCash, Payer: "seller1", Amount: ron(5000)}},
+			wantBuyer:  ron(0),
+			wantSeller: ron(500),
+			wantTill:   ron(-5000),
+		},
+		{
+			want: []TenderRefund{
+				{Payment: 1, Method: TenderCash, Payer: "seller1", Amount: ron(4500)},
+				{Payment: 0, Method: TenderAccount, Payer: "buyer1", Amount: ron(500)},
+			},
+			wantBuyer:  ron(500),
+			wantSeller: ron(0),
+			wantTill:   ron(-9500),
+		},
+	}
+
+	// a refused refund takes no refund number
+	other := Session{Username: "seller2", Profile: ProfileTypeSeller}
+	if _, err := RefundReceipt(other, 1, []RefundLine{{Line: 0, Quantity: 1}}, "returned"); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("refund by another seller error = %v, want %v", err, ErrForbidden)
+	}
+
+	for i, step := range steps {
+		refund, err := RefundReceipt(session, 1, []RefundLine{{Line: 0, Quantity: 1}}, "returned")
+		if err != nil {
+			t.Fatalf("refund %d: %v", i, err)
+		}
+		if refund.Id != MyId(i+1) {
+			t.Errorf("refund %d got number %d, want %d", i, refund.Id, i+1)
+		}
+		if !reflect.DeepEqual(refund.Tenders, step.want) {
+			t.Errorf("refund %d tenders = %+v, want %+v", i, refund.Tenders, step.want)
+		}
+		if got := testBalance(t, buyerAccount); got != step.wantBuyer {
+			t.Errorf("refund %d: buyer balance %s, want %s", i, got, step.wantBuyer)
+		}
+		if got := testBalance(t, sellerAccount); got != step.wantSeller {
+			t.Errorf("refund %d: seller balance %s, want %s", i, got, step.wantSeller)
+		}
+		till, err := TillBalance("seller1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []Money{step.wantTill}; !reflect.DeepEqual(till, want) {
+			t.Errorf("refund %d: till holds %v, want %v", i, till, want)
+		}
+	}
+
+	if _, err := RefundReceipt(session, 1, []RefundLine{{Line: 0, Quantity: 1}}, "again"); !errors.Is(err, ErrRefundTooLarge) {
+		t.Errorf("third refund error = %v, want %v", err, ErrRefundTooLarge)
+	}
+}
@@ -0,0 +1,140 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"time"
+)
+
+// how long an open receipt holds its stock
+var ReservationTTL = 15 * time.Minute
+
+func holdStock(ctx context.Context, id string, quantity float32) error {
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Products)
+
+	// only hold what is neither sold nor held by another receipt
+	free := bson.M{"$subtract": bson.A{"$total_available", bson.M{"$ifNull": bson.A{"$total_reserved", 0}}}}
+	filter := bson.M{"id": id, "$expr": bson.M{"$gte": bson.A{free, quantity}}}
+	update := bson.M{"$inc": bson.M{"total_reserved": quantity}}
+
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		if _, err := getProduct(ctx, id); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: product %s", ErrInsufficientStock, id)
+	}
+
+	return nil
+}
+
+func unholdStock(ctx context.Context, id string, quantity float32) error {
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Products)
+
+	if _, err := collection.UpdateOne(ctx, bson.M{"id": id}, bson.M{"$inc": bson.M{"total_reserved": -quantity}}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ReserveStock holds every product of the receipt. It should run in a
+// transaction so a shortage on one line does not leave the others held.
+func ReserveStock(ctx context.Context, receipt Receipt) error {
+	for _, product := range receipt.Products {
+		if err := holdStock(ctx, product.Id, product.Quantity); err != nil {
+			return err
+		}
+	}
+
+	reservation := Reservation{
+		Receipt:   receipt.Id,
+		Products:  receipt.Products,
+		ExpiresAt: receipt.ExpiresAt,
+	}
+
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Reservations)
+	if _, err := collection.InsertOne(ctx, reservation); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func hasReservation(ctx context.Context, id MyId) (bool, error) {
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Reservations)
+
+	count, err := collection.CountDocuments(ctx, bson.M{"receipt": id})
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// ReleaseReservation gives the stock held for a receipt back. It reports false
+// when the receipt had nothing held, e.g. because the hold already expired.
+func ReleaseReservation(ctx context.Context, id MyId) (bool, error) {
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Reservations)
+
+	var reservation Reservation
+	if err := collection.FindOneAndDelete(ctx, bson.M{"receipt": id}).Decode(&reservation); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	for _, product := range reservation.Products {
+		if err := unholdStock(ctx, product.Id, product.Quantity); err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func ExpireReservations() error {
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Reservations)
+
+	cursor, err := collection.Find(ctx, bson.M{"expires_at": bson.M{"$lt": time.Now()}})
+	if err != nil {
+		return err
+	}
+
+	var expired []Reservation
+	if err := cursor.All(ctx, &expired); err != nil {
+		return err
+	}
+
+	for _, reservation := range expired {
+		err := RunTransaction(func(sessCtx mongo.SessionContext) error {
+			_, err := ReleaseReservation(sessCtx, reservation.Receipt)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RunExpiry cancels expired receipts and releases expired reservations every
+// interval. It does not return.
+func RunExpiry(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := ExpireReceipts(); err != nil {
+			fmt.Println(err)
+		}
+		if err := ExpireReservations(); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
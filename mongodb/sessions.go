@@ -0,0 +1,63 @@
+package mongodb
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"go.mongodb.org/mongo-driver/bson"
+	"time"
+)
+
+// idle time after which a session expires; every use renews it
+var SessionTTL = 2 * time.Hour
+
+// a session is never renewed past this age
+var SessionMaxAge = 7 * 24 * time.Hour
+
+// NewToken returns 256 random bits, url-safe encoded.
+func NewToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken is what the sessions collection stores, so a copy of the
+// database does not contain usable tokens.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func Logout(token string) error {
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Sessions)
+
+	if _, err := collection.DeleteOne(ctx, bson.M{"token_hash": hashToken(token)}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// LogoutAll ends every session of the user owning token, on all devices.
+func LogoutAll(token string) (int64, error) {
+	var session Session
+	var err error
+	if session, err = GetSession(token); err != nil {
+		return 0, err
+	}
+
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Sessions)
+
+	result, err := collection.DeleteMany(ctx, bson.M{"username": session.Username})
+	if err != nil {
+		return 0, err
+	}
+
+	return result.DeletedCount, nil
+}
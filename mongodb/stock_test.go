@@ -0,0 +1,163 @@
+package mongodb
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAllocateLots(t *testing.T) {
+	lot := func(available, sold float32) ProductStock {
+		stock := ProductStock{TotalAvailable: available, TotalSold: sold}
+		if available == 0 {
+			stock.Status = ProductStatusSold
+		}
+		return stock
+	}
+
+	tests := []struct {
+		name      string
+		stocks    []ProductStock
+		quantity  float32
+		want      []ProductStock
+		wantTaken []LotAllocation
+	}{
+		{
+			name:      "first lot only",
+			stocks:    []ProductStock{lot(5, 0), lot(5, 0)},
+			quantity:  3,
+			want:      []ProductStock{lot(2, 3), lot(5, 0)},
+			wantTaken: []LotAllocation{{Lot: 0, Quantity: 3}},
+		},
+		{
+			name:      "empties the first lot",
+			stocks:    []ProductStock{lot(5, 0), lot(5, 0)},
+			quantity:  5,
+			want:      []ProductStock{lot(0, 5), lot(5, 0)},
+			wantTaken: []LotAllocation{{Lot: 0, Quantity: 5}},
+		},
+		{
+			name:      "spills into the next lot",
+			stocks:    []ProductStock{lot(2, 3), lot(5, 0)},
+			quantity:  4,
+			want:      []ProductStock{lot(0, 5), lot(3, 2)},
+			wantTaken: []LotAllocation{{Lot: 0, Quantity: 2}, {Lot: 1, Quantity: 2}},
+		},
+		{
+			name:      "skips sold lots",
+			stocks:    []ProductStock{lot(0, 5), lot(5, 0)},
+			quantity:  1.5,
+			want:      []ProductStock{lot(0, 5), lot(3.5, 1.5)},
+			wantTaken: []LotAllocation{{Lot: 1, Quantity: 1.5}},
+		},
+	}
+
+	for _, tt := range tests {
+		got, taken := allocateLots(tt.stocks, tt.quantity)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: stocks = %+v, want %+v", tt.name, got, tt.want)
+		}
+		if !reflect.DeepEqual(taken, tt.wantTaken) {
+			t.Errorf("%s: taken = %+v, want %+v", tt.name, taken, tt.wantTaken)
+		}
+	}
+}
+
+// Buyers confirming receipts for the last units at the same time, each
+// receipt twice, must sell each unit once and pay for it once: no stock is
+// created or lost, and money only moves between accounts.
+func TestConfirmReceiptConcurrentSales(t *testing.T) {
+	testDb(t)
+
+	const receipts = 25
+	price := ron(500)
+	teller := Session{Username: "teller1", Profile: ProfileTypeManager}
+	testUser(t, "seller1", ProfileTypeSeller, CurrencyRON)
+
+	testInsert(t, MyDb.Products, Product{
+		Id:             "p1",
+		Name:           "apples",
+		Price:          price,
+		TotalAvailable: 10,
+		Stocks: []ProductStock{
+			{Id: "p1", TotalAvailable: 6},
+			{Id: "p1", TotalAvailable: 4},
+		},
+	})
+	for i := 1; i <= receipts; i++ {
+		buyer := fmt.Sprintf("buyer%02d", i)
+		testUser(t, buyer, ProfileTypeBuyer, CurrencyRON)
+		if _, err := Deposit(teller, buyer, price, ""); err != nil {
+			t.Fatal(err)
+		}
+		testInsert(t, MyDb.Receipts, Receipt{
+			Id:         MyId(i),
+			Seller:     "seller1",
+			Status:     ReceiptStatusOpened,
+			CreatedAt:  time.Now(),
+			Products:   []ReceiptProduct{{Id: "p1", Quantity: 1, UnitPrice: price, LineTotal: price}},
+			Subtotal:   price,
+			TotalPrice: price,
+		})
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*receipts)
+	for i := 1; i <= receipts; i++ {
+		for attempt := 0; attempt < 2; attempt++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs <- ConfirmReceipt(fmt.Sprintf("buyer%02d", i), "", i)
+			}(i)
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	sold := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			sold++
+		case !errors.Is(err, ErrInsufficientStock) && !errors.Is(err, ErrReceiptNotOpen):
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	if sold != 10 {
+		t.Errorf("sold %d units, want 10", sold)
+	}
+
+	product, err := GetProduct("p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if product.TotalAvailable+product.TotalSold != 10 || product.TotalSold != float32(sold) {
+		t.Errorf("available %v, sold %v, want %d sold of 10", product.TotalAvailable, product.TotalSold, sold)
+	}
+	var lots float32
+	for _, stock := range product.Stocks {
+		lots += stock.TotalAvailable
+	}
+	if lots != product.TotalAvailable {
+		t.Errorf("lots hold %v, product %v", lots, product.TotalAvailable)
+	}
+
+	seller, err := GetUser("seller1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := price.MulQuantity(float32(sold))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := testBalance(t, seller.AccountId); got != want {
+		t.Errorf("seller balance %s, want %s", got, want)
+	}
+	if total := testMoneyInSystem(t); !total.IsZero() {
+		t.Errorf("accounts and system accounts add up to %s, want 0", total)
+	}
+}
@@ -1,10 +1,15 @@
 package mongodb
 
+import "time"
+
 type ProfileType byte
 
 const (
 	ProfileTypeBuyer  ProfileType = 0
 	ProfileTypeSeller ProfileType = 1
+	ProfileTypeAdmin  ProfileType = 2
+	// managers may void receipts of any seller
+	ProfileTypeManager ProfileType = 3
 )
 
 type ProductStatus byte
@@ -16,54 +21,122 @@ const (
 
 type User struct {
 	Username  string      `json:"username" bson:"username"`
-	Password  string      `json:"password" bson:"password"`
+	Password  string      `json:"-" bson:"password"`
 	Profile   ProfileType `json:"profile" bson:"profile"`
 	AccountId string      `json:"account" bson:"account"`
 }
 
 type Account struct {
-	Id      string  `json:"id" bson:"id"`
-	Balance float32 `json:"balance" bson:"balance"`
+	Id      string `json:"id" bson:"id"`
+	Balance Money  `json:"balance" bson:"balance"`
+	// how far below zero the balance may go, zero means no overdraft
+	CreditLimit Money `json:"credit_limit" bson:"credit_limit"`
 }
 
 type Product struct {
 	Id             string         `json:"id" bson:"id"`
 	Name           string         `json:"name" bson:"name"`
-	Price          float32        `json:"price" bson:"price"`
+	Price          Money          `json:"price" bson:"price"`
+	TaxCategory    TaxCategory    `json:"tax_category" bson:"tax_category"`
 	TotalAvailable float32        `json:"total_available" bson:"total_available"`
+	TotalReserved  float32        `json:"total_reserved" bson:"total_reserved"`
 	TotalSold      float32        `json:"total_sold" bson:"total_sold"`
 	Stocks         []ProductStock `json:"stocks" bson:"stocks"`
+	// temporary prices, see PriceAt
+	PriceOverrides []PriceOverride `json:"price_overrides,omitempty" bson:"price_overrides,omitempty"`
+}
+
+// PriceOverride replaces Product.Price from StartsAt until EndsAt.
+type PriceOverride struct {
+	Price    Money     `json:"price" bson:"price"`
+	StartsAt time.Time `json:"starts_at" bson:"starts_at"`
+	EndsAt   time.Time `json:"ends_at" bson:"ends_at"`
 }
 
 type ReturnProduct struct {
-	Id             string  `json:"id" bson:"id"`
-	Name           string  `json:"name" bson:"name"`
-	Price          float32 `json:"price" bson:"price"`
-	TotalAvailable float32 `json:"total_available" bson:"total_available"`
-	TotalSold      float32 `json:"total_sold" bson:"total_sold"`
+	Id             string      `json:"id" bson:"id"`
+	Name           string      `json:"name" bson:"name"`
+	Price          Money       `json:"price" bson:"price"`
+	TaxCategory    TaxCategory `json:"tax_category" bson:"tax_category"`
+	TotalAvailable float32     `json:"total_available" bson:"total_available"`
+	TotalReserved  float32     `json:"total_reserved" bson:"total_reserved"`
+	TotalSold      float32     `json:"total_sold" bson:"total_sold"`
 }
 
 type ReturnProductF struct {
-	Id             string  `json:"id" bson:"id"`
-	Name           string  `json:"name" bson:"name"`
-	Price          float32 `json:"price" bson:"price"`
-	Quantity       int     `json:"quantity" bson:"quantity"`
-	TotalAvailable float32 `json:"total_available" bson:"total_available"`
-	TotalSold      float32 `json:"total_sold" bson:"total_sold"`
+	Id          string      `json:"id" bson:"id"`
+	Name        string      `json:"name" bson:"name"`
+	Price       Money       `json:"price" bson:"price"`
+	Quantity    float32     `json:"quantity" bson:"quantity"`
+	TaxCategory TaxCategory `json:"tax_category" bson:"tax_category"`
+	TaxRate     TaxRate     `json:"tax_rate" bson:"tax_rate"`
+	Tax         Money       `json:"tax" bson:"tax"`
+	Discount    Money       `json:"discount" bson:"discount"`
+	LineTotal   Money       `json:"line_total" bson:"line_total"`
 }
 
 type ProductStock struct {
 	Id             string        `json:"id" bson:"id"`
 	Name           string        `json:"name" bson:"name"`
-	Price          float32       `json:"price" bson:"price"`
+	Price          Money         `json:"price" bson:"price"`
 	TotalAvailable float32       `json:"total_available" bson:"total_available"`
 	TotalSold      float32       `json:"total_sold" bson:"total_sold"`
 	Status         ProductStatus `json:"status" bson:"status"`
 }
 
+// TaxRate is in basis points: 1900 is 19%.
+type TaxRate int
+
+// TaxCategory groups products taxed alike; its rate comes from the tax_rates
+// collection, see GetTaxRates.
+type TaxCategory string
+
+const (
+	TaxCategoryStandard TaxCategory = "standard"
+	TaxCategoryReduced  TaxCategory = "reduced"
+	TaxCategoryExempt   TaxCategory = "exempt"
+)
+
+type TaxRateEntry struct {
+	Category TaxCategory `json:"category" bson:"category"`
+	Rate     TaxRate     `json:"rate" bson:"rate"`
+}
+
+// TaxTotal is the part of a receipt taxed at Rate. Prices include tax, so
+// Gross is Net + Tax.
+type TaxTotal struct {
+	Rate  TaxRate `json:"rate" bson:"rate"`
+	Net   Money   `json:"net" bson:"net"`
+	Tax   Money   `json:"tax" bson:"tax"`
+	Gross Money   `json:"gross" bson:"gross"`
+}
+
+// A receipt line keeps the product as it was sold. Clients only send id and
+// quantity, the rest is copied from the catalogue when the line is created.
 type ReceiptProduct struct {
-	Id       string  `json:"id" bson:"id"`
+	Id        string  `json:"id" bson:"id"`
+	Quantity  float32 `json:"quantity" bson:"quantity"`
+	Name      string  `json:"name" bson:"name"`
+	UnitPrice Money   `json:"unit_price" bson:"unit_price"`
+	// rate of the category when the line was created
+	TaxCategory TaxCategory `json:"tax_category" bson:"tax_category"`
+	TaxRate     TaxRate     `json:"tax_rate" bson:"tax_rate"`
+	// LineTotal is UnitPrice * Quantity minus Discount and includes Tax
+	Discount  Money `json:"discount" bson:"discount"`
+	Tax       Money `json:"tax" bson:"tax"`
+	LineTotal Money `json:"line_total" bson:"line_total"`
+	// set when the receipt is confirmed
+	Lots []LotAllocation `json:"lots,omitempty" bson:"lots,omitempty"`
+	// what was given back so far by refunds
+	Refunded       float32 `json:"refunded" bson:"refunded"`
+	RefundedAmount Money   `json:"refunded_amount" bson:"refunded_amount"`
+}
+
+// LotAllocation is the quantity a sale took from Product.Stocks[Lot].
+type LotAllocation struct {
+	Lot      int     `json:"lot" bson:"lot"`
 	Quantity float32 `json:"quantity" bson:"quantity"`
+	Returned float32 `json:"returned" bson:"returned"`
 }
 
 type ReceiptStatus byte
@@ -71,35 +144,217 @@ type ReceiptStatus byte
 const (
 	ReceiptStatusOpened ReceiptStatus = 0
 	ReceiptStatusClosed ReceiptStatus = 1
+	// abandoned by its seller or expired
+	ReceiptStatusCancelled ReceiptStatus = 2
+	// cancelled by a manager
+	ReceiptStatusVoided ReceiptStatus = 3
 )
 
-type Currency byte
+type CancelReason string
+
+const (
+	CancelReasonCustomerLeft  CancelReason = "customer_left"
+	CancelReasonOperatorError CancelReason = "operator_error"
+	CancelReasonPriceDispute  CancelReason = "price_dispute"
+	CancelReasonExpired       CancelReason = "expired"
+	CancelReasonOther         CancelReason = "other"
+)
+
+type TenderType string
+
+const (
+	// debited from the payer's account
+	TenderAccount TenderType = "account"
+	TenderCash    TenderType = "cash"
+	TenderCard    TenderType = "card"
+	TenderVoucher TenderType = "voucher"
+)
+
+// Voucher is a prepaid code taken as tender. Balance is what is left of Amount.
+type Voucher struct {
+	Code      string     `json:"code" bson:"code"`
+	Amount    Money      `json:"amount" bson:"amount"`
+	Balance   Money      `json:"balance" bson:"balance"`
+	IssuedBy  string     `json:"issued_by" bson:"issued_by"`
+	IssuedAt  time.Time  `json:"issued_at" bson:"issued_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+}
 
 // metoda de plata
 type Payment struct {
-	Currency Currency `json:"currency" bson:"currency"`
-	Balance  float32  `json:"balance" bson:"balance"`
+	Method TenderType `json:"method" bson:"method"`
+	// what went towards the receipt total
+	Amount Money `json:"amount" bson:"amount"`
+	// cash only: what was handed over and what was given back
+	Tendered Money `json:"tendered" bson:"tendered"`
+	Change   Money `json:"change" bson:"change"`
+	// card authorization or voucher code
+	Reference string    `json:"reference,omitempty" bson:"reference,omitempty"`
+	Payer     string    `json:"payer" bson:"payer"`
+	At        time.Time `json:"at" bson:"at"`
+	// given back by refunds so far
+	Refunded Money `json:"refunded" bson:"refunded"`
+	// credited to the seller's till rather than their account, see SettleTill
+	Till bool `json:"till,omitempty" bson:"till,omitempty"`
 }
 
 type MyId int
 
 type Receipt struct {
-	Id         MyId             `json:"id" bson:"id"`
-	Products   []ReceiptProduct `json:"products" bson:"products"`
-	TotalPrice float32          `json:"total" bson:"total"`
-	Status     ReceiptStatus    `json:"status" bson:"status"`
+	Id          MyId             `json:"id" bson:"id"`
+	Number      string           `json:"number,omitempty" bson:"number,omitempty"`
+	Seller      string           `json:"seller" bson:"seller"`
+	Buyer       string           `json:"buyer,omitempty" bson:"buyer,omitempty"`
+	Terminal    string           `json:"terminal,omitempty" bson:"terminal,omitempty"`
+	CreatedAt   time.Time        `json:"created_at" bson:"created_at"`
+	ConfirmedAt *time.Time       `json:"confirmed_at,omitempty" bson:"confirmed_at,omitempty"`
+	Products    []ReceiptProduct `json:"products" bson:"products"`
+	// TotalPrice is Subtotal minus Discount, see PriceReceipt
+	Subtotal   Money              `json:"subtotal" bson:"subtotal"`
+	Discount   Money              `json:"discount" bson:"discount"`
+	Coupons    []string           `json:"coupons,omitempty" bson:"coupons,omitempty"`
+	Promotions []AppliedPromotion `json:"promotions,omitempty" bson:"promotions,omitempty"`
+	// TotalPrice split by tax rate, see applyTaxes
+	Net        Money      `json:"net" bson:"net"`
+	Tax        Money      `json:"tax" bson:"tax"`
+	Taxes      []TaxTotal `json:"taxes,omitempty" bson:"taxes,omitempty"`
+	TotalPrice Money      `json:"total" bson:"total"`
+	// the receipt closes once Paid reaches TotalPrice
+	Payments []Payment `json:"payments,omitempty" bson:"payments,omitempty"`
+	Paid     Money     `json:"paid" bson:"paid"`
+	// set on payment for accounts in another currency than TotalPrice
+	Conversions []Conversion  `json:"conversions,omitempty" bson:"conversions,omitempty"`
+	Status      ReceiptStatus `json:"status" bson:"status"`
+	// an open receipt is cancelled automatically after this
+	ExpiresAt    time.Time    `json:"expires_at" bson:"expires_at"`
+	CancelReason CancelReason `json:"cancel_reason,omitempty" bson:"cancel_reason,omitempty"`
+	CancelledBy  string       `json:"cancelled_by,omitempty" bson:"cancelled_by,omitempty"`
+	CancelledAt  *time.Time   `json:"cancelled_at,omitempty" bson:"cancelled_at,omitempty"`
+}
+
+type PromotionKind string
+
+const (
+	// BasisPoints off, 1000 is 10%
+	PromotionPercent PromotionKind = "percent"
+	// Amount off, at most the price
+	PromotionFixed PromotionKind = "fixed"
+	// of every Buy+Get units Get are free
+	PromotionBuyXGetY PromotionKind = "buy_x_get_y"
+	// every Buy units cost Amount together
+	PromotionMultiBuy PromotionKind = "multi_buy"
+)
+
+// A Promotion applies to the lines of Product, or to the whole receipt when
+// Product is empty (percent and fixed only). With a Coupon it only applies to
+// receipts the code was entered on, at most UsageLimit times if that is set.
+type Promotion struct {
+	Id          string        `json:"id" bson:"id"`
+	Name        string        `json:"name" bson:"name"`
+	Kind        PromotionKind `json:"kind" bson:"kind"`
+	Product     string        `json:"product,omitempty" bson:"product,omitempty"`
+	BasisPoints int           `json:"basis_points,omitempty" bson:"basis_points,omitempty"`
+	Amount      Money         `json:"amount" bson:"amount"`
+	Buy         int           `json:"buy,omitempty" bson:"buy,omitempty"`
+	Get         int           `json:"get,omitempty" bson:"get,omitempty"`
+	Coupon      string        `json:"coupon,omitempty" bson:"coupon,omitempty"`
+	UsageLimit  int           `json:"usage_limit,omitempty" bson:"usage_limit,omitempty"`
+	Used        int           `json:"used" bson:"used"`
+	StartsAt    *time.Time    `json:"starts_at,omitempty" bson:"starts_at,omitempty"`
+	EndsAt      *time.Time    `json:"ends_at,omitempty" bson:"ends_at,omitempty"`
+}
+
+// AppliedPromotion is what a promotion took off a receipt. Line is -1 for
+// promotions on the whole receipt.
+type AppliedPromotion struct {
+	Id     string        `json:"id" bson:"id"`
+	Name   string        `json:"name" bson:"name"`
+	Kind   PromotionKind `json:"kind" bson:"kind"`
+	Coupon string        `json:"coupon,omitempty" bson:"coupon,omitempty"`
+	Line   int           `json:"line" bson:"line"`
+	Amount Money         `json:"amount" bson:"amount"`
+}
+
+// ExchangeRate is how many units of To one unit of From buys.
+type ExchangeRate struct {
+	From Currency `json:"from" bson:"from"`
+	To   Currency `json:"to" bson:"to"`
+	// a decimal such as "4.9750", kept as text so it stays exact
+	Rate      string    `json:"rate" bson:"rate"`
+	UpdatedAt time.Time `json:"updated_at" bson:"updated_at"`
+}
+
+// Conversion is what an account was debited or credited for a receipt in
+// another currency, and the rate used.
+type Conversion struct {
+	Account string `json:"account" bson:"account"`
+	Rate    string `json:"rate" bson:"rate"`
+	Amount  Money  `json:"amount" bson:"amount"`
+}
+
+// stock held for an open receipt until it is confirmed, cancelled or expires
+type Reservation struct {
+	Receipt   MyId             `json:"receipt" bson:"receipt"`
+	Products  []ReceiptProduct `json:"products" bson:"products"`
+	ExpiresAt time.Time        `json:"expires_at" bson:"expires_at"`
+}
+
+// RefundLine gives back Quantity of receipt line Line.
+type RefundLine struct {
+	Line     int     `json:"line" bson:"line"`
+	Id       string  `json:"id" bson:"id"`
+	Quantity float32 `json:"quantity" bson:"quantity"`
+	Amount   Money   `json:"amount" bson:"amount"`
+}
+
+// TenderRefund is the part of a refund given back to the tender of one
+// payment. Payment is its index in Receipt.Payments, -1 for receipts closed
+// before payments were recorded.
+type TenderRefund struct {
+	Payment   int        `json:"payment" bson:"payment"`
+	Method    TenderType `json:"method" bson:"method"`
+	Reference string     `json:"reference,omitempty" bson:"reference,omitempty"`
+	Payer     string     `json:"payer,omitempty" bson:"payer,omitempty"`
+	Amount    Money      `json:"amount" bson:"amount"`
+}
+
+type Refund struct {
+	Id        MyId           `json:"id" bson:"id"`
+	Receipt   MyId           `json:"receipt" bson:"receipt"`
+	Lines     []RefundLine   `json:"lines" bson:"lines"`
+	Total     Money          `json:"total" bson:"total"`
+	Tenders   []TenderRefund `json:"tenders" bson:"tenders"`
+	Reason    string         `json:"reason" bson:"reason"`
+	CreatedBy string         `json:"created_by" bson:"created_by"`
+	CreatedAt time.Time      `json:"created_at" bson:"created_at"`
 }
 
+type Sequence string
+
+const (
+	SequenceReceipts Sequence = "receipts"
+	SequenceInvoices Sequence = "invoices"
+	SequenceRefunds  Sequence = "refunds"
+)
+
+// one document per sequence, id is the last number handed out
 type IdGenerator struct {
-	Id MyId `json:"id" bson:"id"`
+	Name Sequence `json:"name" bson:"name"`
+	Id   MyId     `json:"id" bson:"id"`
 }
 
+// only the hash of a token is stored, the token itself is returned once by Login
 type Session struct {
-	Token    string      `json:"token" bson:"token"`
-	Username string      `json:"username" bson:"username"`
-	Profile  ProfileType `json:"profile" bson:"profile"`
+	Token     string      `json:"token" bson:"-"`
+	TokenHash string      `json:"-" bson:"token_hash"`
+	Username  string      `json:"username" bson:"username"`
+	Profile   ProfileType `json:"profile" bson:"profile"`
+	IssuedAt  time.Time   `json:"issued_at" bson:"issued_at"`
+	ExpiresAt time.Time   `json:"expires_at" bson:"expires_at"`
 }
 
 type ResponseStatus struct {
-	Status bool `json:"status"`
+	Status bool   `json:"status"`
+	Step   string `json:"step,omitempty"`
+	Code   string `json:"code,omitempty"`
 }
@@ -0,0 +1,171 @@
+package mongodb
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// rates of categories missing from the tax_rates collection (Romanian VAT
+// since August 2025)
+var DefaultTaxRates = map[TaxCategory]TaxRate{
+	TaxCategoryStandard: 2100,
+	TaxCategoryReduced:  1100,
+	TaxCategoryExempt:   0,
+}
+
+func (c TaxCategory) orDefault() TaxCategory {
+	if c == "" {
+		return TaxCategoryStandard
+	}
+	return c
+}
+
+// GetTaxRates returns the rate of every known category.
+func GetTaxRates(ctx context.Context) (map[TaxCategory]TaxRate, error) {
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.TaxRates)
+
+	cursor, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []TaxRateEntry
+	if err = cursor.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+
+	rates := map[TaxCategory]TaxRate{}
+	for category, rate := range DefaultTaxRates {
+		rates[category] = rate
+	}
+	for _, entry := range entries {
+		rates[entry.Category] = entry.Rate
+	}
+
+	return rates, nil
+}
+
+func GetTaxRate(category TaxCategory) (TaxRate, error) {
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	rates, err := GetTaxRates(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	rate, ok := rates[category.orDefault()]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidTaxCategory, category)
+	}
+	return rate, nil
+}
+
+// SetTaxRate adds a category or changes its rate. Open and closed receipts
+// keep the rate their lines were created with.
+func SetTaxRate(category TaxCategory, rate TaxRate) error {
+	if category == "" || len(category) > 32 {
+		return ErrInvalidTaxCategory
+	}
+	if rate < 0 || rate > 10000 {
+		return ErrInvalidTaxRate
+	}
+
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.TaxRates)
+
+	filter := bson.M{"category": category}
+	update := bson.M{"$set": bson.M{"rate": rate}}
+
+	if _, err := collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SetProductTaxCategory moves a product to another category. Receipt lines
+// keep the category and rate they were created with.
+func SetProductTaxCategory(productId string, category TaxCategory) error {
+	if _, err := GetTaxRate(category); err != nil || category == "" {
+		return ErrInvalidTaxCategory
+	}
+
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Products)
+
+	update := bson.M{"$set": bson.M{"tax_category": category}}
+	result, err := collection.UpdateOne(ctx, bson.M{"id": productId}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+// includedTax is the tax contained in a price that includes it:
+// gross * rate / (1 + rate).
+func includedTax(gross Money, rate TaxRate) (Money, error) {
+	share := big.NewRat(int64(rate), int64(10000+rate))
+	return moneyFromRat(new(big.Rat).Mul(gross.Rat(), share), gross.Currency)
+}
+
+// applyTaxes works out the tax of every line from its final total and sums
+// lines by rate into Net, Tax and Taxes.
+func applyTaxes(receipt *Receipt) error {
+	var err error
+	receipt.Net = Money{}
+	receipt.Tax = Money{}
+	receipt.Taxes = nil
+
+	byRate := map[TaxRate]int{}
+	for i := range receipt.Products {
+		line := &receipt.Products[i]
+		if line.Tax, err = includedTax(line.LineTotal, line.TaxRate); err != nil {
+			return err
+		}
+
+		var net Money
+		if net, err = line.LineTotal.Sub(line.Tax); err != nil {
+			return err
+		}
+
+		j, ok := byRate[line.TaxRate]
+		if !ok {
+			j = len(receipt.Taxes)
+			byRate[line.TaxRate] = j
+			receipt.Taxes = append(receipt.Taxes, TaxTotal{Rate: line.TaxRate})
+		}
+		total := &receipt.Taxes[j]
+		if total.Net, err = total.Net.Add(net); err != nil {
+			return err
+		}
+		if total.Tax, err = total.Tax.Add(line.Tax); err != nil {
+			return err
+		}
+		if total.Gross, err = total.Gross.Add(line.LineTotal); err != nil {
+			return err
+		}
+
+		if receipt.Net, err = receipt.Net.Add(net); err != nil {
+			return err
+		}
+		if receipt.Tax, err = receipt.Tax.Add(line.Tax); err != nil {
+			return err
+		}
+	}
+
+	// highest rate first, as printed on fiscal receipts
+	sort.Slice(receipt.Taxes, func(i, j int) bool {
+		return receipt.Taxes[i].Rate > receipt.Taxes[j].Rate
+	})
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package mongodb
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"time"
+)
+
+// TillPrefix followed by a seller's username is the system account holding
+// the cash and card payments that seller took, until a manager settles them
+// into the seller's account.
+const TillPrefix = "system:till:"
+
+func tillAccount(seller string) string {
+	return TillPrefix + seller
+}
+
+// TillBalance is what the till of seller holds, one amount per currency.
+func TillBalance(seller string) ([]Money, error) {
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	return tillBalance(ctx, seller)
+}
+
+func tillBalance(ctx context.Context, seller string) ([]Money, error) {
+	till := tillAccount(seller)
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"postings.account": till}}},
+		{{Key: "$unwind", Value: "$postings"}},
+		{{Key: "$match", Value: bson.M{"postings.account": till}}},
+		{{Key: "$group", Value: bson.M{"_id": "$postings.amount.currency", "total": bson.M{"$sum": "$postings.amount.amount"}}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	}
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Ledger)
+
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		Currency Currency             `bson:"_id"`
+		Total    primitive.Decimal128 `bson:"total"`
+	}
+	if err = cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+
+	balance := []Money{}
+	for _, row := range rows {
+		total, err := ParseMoney(row.Total.String(), row.Currency)
+		if err != nil {
+			return nil, err
+		}
+		balance = append(balance, total)
+	}
+	return balance, nil
+}
+
+// SettleTill moves amount, in a currency the till holds, out of the till of
+// seller into the seller's account, converted at today's rate if the account
+// is in another currency. Admins and managers settle a till once they have
+// counted the cash and seen the card payments arrive.
+func SettleTill(session Session, seller string, amount Money, memo string) (StatementLine, error) {
+	if session.Profile != ProfileTypeAdmin && session.Profile != ProfileTypeManager {
+		return StatementLine{}, ErrForbidden
+	}
+	if amount.Amount <= 0 {
+		return StatementLine{}, ErrInvalidAmount
+	}
+	if len(memo) > MaxMemoLength {
+		return StatementLine{}, ErrInvalidMemo
+	}
+	amount = NewMoney(amount.Amount, amount.Currency)
+
+	return moveMoney(session, seller, func(ctx mongo.SessionContext, account Account) (LedgerEntry, error) {
+		balance, err := tillBalance(ctx, seller)
+		if err != nil {
+			return LedgerEntry{}, err
+		}
+		held := NewMoney(0, amount.Currency)
+		for _, total := range balance {
+			if total.Currency == amount.Currency {
+				held = total
+			}
+		}
+		if c, err := amount.Cmp(held); err != nil {
+			return LedgerEntry{}, err
+		} else if c > 0 {
+			return LedgerEntry{}, fmt.Errorf("%w: %s %s held", ErrTillShort, held, held.Currency)
+		}
+
+		credit := amount
+		if amount.Currency != account.Currency() {
+			if credit, _, err = convert(ctx, amount, account.Currency()); err != nil {
+				return LedgerEntry{}, err
+			}
+		}
+		if err := UpdateAccount(ctx, account.Id, credit); err != nil {
+			return LedgerEntry{}, err
+		}
+
+		return LedgerEntry{
+			Kind: LedgerSettlement,
+			Memo: memo,
+			Postings: []Posting{
+				{Account: tillAccount(seller), Amount: amount.Neg()},
+				{Account: account.Id, Amount: credit},
+			},
+		}, nil
+	})
+}
@@ -0,0 +1,69 @@
+package mongodb
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Cash taken by a seller waits in their till and reaches their account only
+// as far as a manager settles it.
+func TestSettleTill(t *testing.T) {
+	testDb(t)
+
+	sellerAccount := testUser(t, "seller1", ProfileTypeSeller, CurrencyRON)
+	testInsert(t, MyDb.Receipts, Receipt{
+		Id:         1,
+		Seller:     "seller1",
+		Status:     ReceiptStatusOpened,
+		CreatedAt:  time.Now(),
+		TotalPrice: ron(10000),
+	})
+
+	seller := Session{Username: "seller1", Profile: ProfileTypeSeller}
+	receipt, err := PayReceipt(seller, 1, Payment{Method: TenderCash, Amount: ron(6000), Tendered: ron(6000)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !receipt.Payments[0].Till {
+		t.Errorf("cash payment not marked as held in the till")
+	}
+	if got := testBalance(t, sellerAccount); got != ron(0) {
+		t.Errorf("seller balance %s after cash payment, want 0.00", got)
+	}
+
+	manager := Session{Username: "manager1", Profile: ProfileTypeManager}
+	steps := []struct {
+		name    string
+		session Session
+		amount  Money
+		wantErr error
+	}{
+		{"seller settles", seller, ron(6000), ErrForbidden},
+		{"more than the till", manager, ron(6001), ErrTillShort},
+		{"currency not held", manager, NewMoney(100, CurrencyEUR), ErrTillShort},
+		{"part", manager, ron(4000), nil},
+		{"rest", manager, ron(2000), nil},
+		{"empty till", manager, ron(1), ErrTillShort},
+	}
+	for _, step := range steps {
+		if _, err := SettleTill(step.session, "seller1", step.amount, "count"); !errors.Is(err, step.wantErr) {
+			t.Fatalf("%s: error = %v, want %v", step.name, err, step.wantErr)
+		}
+	}
+
+	if got := testBalance(t, sellerAccount); got != ron(6000) {
+		t.Errorf("seller balance %s, want 60.00", got)
+	}
+	till, err := TillBalance("seller1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Money{ron(0)}; !reflect.DeepEqual(till, want) {
+		t.Errorf("till holds %v, want %v", till, want)
+	}
+	if got := testMoneyInSystem(t); !got.IsZero() {
+		t.Errorf("money in system %s, want 0.00", got)
+	}
+}
@@ -0,0 +1,78 @@
+package mongodb
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"regexp"
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9._-]{3,32}$`)
+
+type UserProfile struct {
+	Username string      `json:"username"`
+	Profile  ProfileType `json:"profile"`
+	Account  Account     `json:"account"`
+}
+
+func (p ProfileType) Valid() bool {
+	switch p {
+	case ProfileTypeBuyer, ProfileTypeSeller, ProfileTypeAdmin, ProfileTypeManager:
+		return true
+	}
+	return false
+}
+
+// RegisterUser creates a user together with an empty account in currency.
+func RegisterUser(username string, password string, profile ProfileType, currency Currency) (UserProfile, error) {
+	if !usernamePattern.MatchString(username) {
+		return UserProfile{}, ErrInvalidUsername
+	}
+	if !profile.Valid() {
+		return UserProfile{}, ErrInvalidProfile
+	}
+	if err := checkPassword(password); err != nil {
+		return UserProfile{}, err
+	}
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	if !currency.Valid() {
+		return UserProfile{}, ErrInvalidCurrency
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return UserProfile{}, err
+	}
+
+	account := Account{
+		Id:          primitive.NewObjectID().Hex(),
+		Balance:     NewMoney(0, currency),
+		CreditLimit: NewMoney(0, currency),
+	}
+	user := User{
+		Username:  username,
+		Password:  hash,
+		Profile:   profile,
+		AccountId: account.Id,
+	}
+
+	err = RunTransaction(func(sessCtx mongo.SessionContext) error {
+		db := Client.Database(MyDb.DbName)
+		if _, err := db.Collection(MyDb.Accounts).InsertOne(sessCtx, account); err != nil {
+			return err
+		}
+		if _, err := db.Collection(MyDb.Users).InsertOne(sessCtx, user); err != nil {
+			if mongo.IsDuplicateKeyError(err) {
+				return ErrUsernameTaken
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return UserProfile{}, err
+	}
+
+	return UserProfile{Username: username, Profile: profile, Account: account}, nil
+}
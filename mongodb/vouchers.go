@@ -0,0 +1,133 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var voucherCodePattern = regexp.MustCompile(`^[A-Z0-9-]{6,64}$`)
+
+// IssueVoucher stores a new voucher worth Amount, spendable until ExpiresAt if
+// that is set. Codes are not case sensitive.
+func IssueVoucher(session Session, voucher Voucher) (Voucher, error) {
+	voucher.Code = normalizeCoupon(voucher.Code)
+	if !voucherCodePattern.MatchString(voucher.Code) {
+		return Voucher{}, fmt.Errorf("%w: code must be 6-64 letters, digits or '-'", ErrInvalidVoucher)
+	}
+	if voucher.Amount.Amount <= 0 {
+		return Voucher{}, ErrInvalidAmount
+	}
+	if !voucher.Amount.Currency.orDefault().Valid() {
+		return Voucher{}, ErrInvalidCurrency
+	}
+
+	voucher.Amount = NewMoney(voucher.Amount.Amount, voucher.Amount.Currency)
+	voucher.Balance = voucher.Amount
+	voucher.IssuedBy = session.Username
+	voucher.IssuedAt = time.Now()
+
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Vouchers)
+
+	if _, err := collection.InsertOne(ctx, voucher); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return Voucher{}, fmt.Errorf("%w: code %s is taken", ErrInvalidVoucher, voucher.Code)
+		}
+		return Voucher{}, err
+	}
+
+	return voucher, nil
+}
+
+// redeemVoucher takes amount off the balance of a voucher that has not expired,
+// only if enough is left.
+func redeemVoucher(ctx context.Context, code string, amount Money) error {
+	code = normalizeCoupon(code)
+	minimum, err := amount.Decimal128()
+	if err != nil {
+		return err
+	}
+	delta, err := amount.Neg().Decimal128()
+	if err != nil {
+		return err
+	}
+
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Vouchers)
+	filter := bson.M{
+		"code":             code,
+		"balance.currency": amount.Currency.orDefault(),
+		"balance.amount":   bson.M{"$gte": minimum},
+		"$or":              bson.A{bson.M{"expires_at": nil}, bson.M{"expires_at": bson.M{"$gt": time.Now()}}},
+	}
+
+	result, err := collection.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"balance.amount": delta}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 1 {
+		return nil
+	}
+
+	// tell apart why the voucher could not pay
+	var voucher Voucher
+	if err := collection.FindOne(ctx, bson.M{"code": code}).Decode(&voucher); errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrInvalidVoucher
+	} else if err != nil {
+		return err
+	}
+	if voucher.ExpiresAt != nil && !voucher.ExpiresAt.After(time.Now()) {
+		return fmt.Errorf("%w: expired %s", ErrInvalidVoucher, voucher.ExpiresAt.Format(time.RFC3339))
+	}
+	if voucher.Balance.Currency != amount.Currency.orDefault() {
+		return fmt.Errorf("%w: voucher is in %s", ErrInvalidCurrency, voucher.Balance.Currency)
+	}
+	return fmt.Errorf("%w: %s left", ErrVoucherBalance, voucher.Balance)
+}
+
+// restoreVoucher puts a refunded amount back on a voucher, expired or not.
+func restoreVoucher(ctx context.Context, code string, amount Money) error {
+	delta, err := amount.Decimal128()
+	if err != nil {
+		return err
+	}
+
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.Vouchers)
+	filter := bson.M{"code": normalizeCoupon(code), "balance.currency": amount.Currency.orDefault()}
+
+	result, err := collection.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"balance.amount": delta}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidVoucher, code)
+	}
+
+	return nil
+}
+
+// claimReference records that a tender reference, such as a card
+// authorization code, paid for receipt. A reference pays only once.
+func claimReference(ctx context.Context, method TenderType, reference string, receipt MyId) error {
+	collection := Client.Database(MyDb.DbName).Collection(MyDb.TenderRefs)
+
+	doc := bson.M{
+		"method":    method,
+		"reference": strings.TrimSpace(reference),
+		"receipt":   receipt,
+		"at":        time.Now(),
+	}
+	if _, err := collection.InsertOne(ctx, doc); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("%w: %s %s", ErrReferenceUsed, method, reference)
+		}
+		return err
+	}
+
+	return nil
+}
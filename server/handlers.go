@@ -3,10 +3,11 @@ package server
 import (
 	"banking/mongodb"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"math"
 	"net/http"
+	"time"
 )
 
 func TestHandler(res http.ResponseWriter, req *http.Request) {
@@ -60,9 +61,8 @@ func LoginHandler(res http.ResponseWriter, req *http.Request) {
 	}
 
 	type tmp struct {
-		Username string              `json:"username"`
-		Password string              `json:"password"`
-		Profile  mongodb.ProfileType `json:"profile"`
+		Username string `json:"username"`
+		Password string `json:"password"`
 	}
 
 	var query tmp
@@ -72,7 +72,7 @@ func LoginHandler(res http.ResponseWriter, req *http.Request) {
 	}
 
 	var session mongodb.Session
-	if session, err = mongodb.Login(query.Username, query.Password, query.Profile); err != nil {
+	if session, err = mongodb.Login(query.Username, query.Password); err != nil {
 		res.WriteHeader(http.StatusUnauthorized)
 		return
 	}
@@ -83,6 +83,206 @@ func LoginHandler(res http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func LogoutHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	status := mongodb.ResponseStatus{Status: false}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	type tmp struct {
+		Token string `json:"token"`
+	}
+
+	var query tmp
+	if err = json.Unmarshal(body, &query); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(res).Encode(status)
+		return
+	}
+
+	if err := mongodb.Logout(query.Token); err != nil {
+		fmt.Println(err)
+		res.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(res).Encode(status)
+		return
+	}
+
+	status.Status = true
+	_ = json.NewEncoder(res).Encode(status)
+}
+
+func LogoutAllHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	type tmp struct {
+		Token string `json:"token"`
+	}
+
+	var query tmp
+	if err = json.Unmarshal(body, &query); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	count, err := mongodb.LogoutAll(query.Token)
+	if err != nil {
+		fmt.Println(err)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	type ans struct {
+		Status   bool  `json:"status"`
+		Sessions int64 `json:"sessions"`
+	}
+
+	_ = json.NewEncoder(res).Encode(ans{Status: true, Sessions: count})
+}
+
+type registerQuery struct {
+	Token    string              `json:"token"`
+	Username string              `json:"username"`
+	Password string              `json:"password"`
+	Profile  mongodb.ProfileType `json:"profile"`
+	Currency mongodb.Currency    `json:"currency"`
+}
+
+func writeRegisterError(res http.ResponseWriter, err error) {
+	status := mongodb.ResponseStatus{Status: false}
+	switch {
+	case errors.Is(err, mongodb.ErrForbidden):
+		res.WriteHeader(http.StatusForbidden)
+	case errors.Is(err, mongodb.ErrUsernameTaken):
+		status.Code = "username_taken"
+		res.WriteHeader(http.StatusConflict)
+	case errors.Is(err, mongodb.ErrInvalidUsername):
+		status.Code = "invalid_username"
+		res.WriteHeader(http.StatusBadRequest)
+	case errors.Is(err, mongodb.ErrInvalidProfile):
+		status.Code = "invalid_profile"
+		res.WriteHeader(http.StatusBadRequest)
+	case errors.Is(err, mongodb.ErrWeakPassword):
+		status.Code = "weak_password"
+		res.WriteHeader(http.StatusBadRequest)
+	case errors.Is(err, mongodb.ErrPasswordTooLong):
+		status.Code = "password_too_long"
+		res.WriteHeader(http.StatusBadRequest)
+	case errors.Is(err, mongodb.ErrInvalidCurrency):
+		status.Code = "invalid_currency"
+		res.WriteHeader(http.StatusBadRequest)
+	default:
+		res.WriteHeader(http.StatusInternalServerError)
+	}
+	_ = json.NewEncoder(res).Encode(status)
+}
+
+func UserRegister(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var query registerQuery
+	if err = json.Unmarshal(body, &query); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// sellers take money at the till and administrators run the shop, so both
+	// are only created through the admin endpoint
+	if query.Profile != mongodb.ProfileTypeBuyer {
+		res.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	profile, err := mongodb.RegisterUser(query.Username, query.Password, query.Profile, query.Currency)
+	if err != nil {
+		fmt.Println(err)
+		writeRegisterError(res, err)
+		return
+	}
+
+	res.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(res).Encode(profile)
+}
+
+func AdminUserRegister(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var query registerQuery
+	if err = json.Unmarshal(body, &query); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	profile, err := mongodb.RegisterUser(query.Username, query.Password, query.Profile, query.Currency)
+	if err != nil {
+		fmt.Println(err)
+		writeRegisterError(res, err)
+		return
+	}
+
+	res.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(res).Encode(profile)
+}
+
+func AdminResetPassword(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	status := mongodb.ResponseStatus{Status: false}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	type tmp struct {
+		Token    string `json:"token"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+
+	var query tmp
+	if err = json.Unmarshal(body, &query); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(res).Encode(status)
+		return
+	}
+
+	if err := mongodb.SetPassword(query.Username, query.Password); err != nil {
+		fmt.Println(err)
+		switch {
+		case errors.Is(err, mongodb.ErrWeakPassword):
+			status.Code = "weak_password"
+			res.WriteHeader(http.StatusBadRequest)
+		case errors.Is(err, mongodb.ErrPasswordTooLong):
+			status.Code = "password_too_long"
+			res.WriteHeader(http.StatusBadRequest)
+		default:
+			res.WriteHeader(http.StatusBadRequest)
+		}
+		_ = json.NewEncoder(res).Encode(status)
+		return
+	}
+
+	status.Status = true
+	_ = json.NewEncoder(res).Encode(status)
+}
+
 func ProductAdd(res http.ResponseWriter, req *http.Request) {
 	res.Header().Set("Content-Type", "application/json")
 	status := mongodb.ResponseStatus{Status: false}
@@ -97,36 +297,551 @@ func ProductAdd(res http.ResponseWriter, req *http.Request) {
 	}
 
 	type tmp struct {
-		Token        string               `json:"token"`
-		ProductStock mongodb.ProductStock `json:"product_stock"`
+		Token        string               `json:"token"`
+		ProductStock mongodb.ProductStock `json:"product_stock"`
+		TaxCategory  mongodb.TaxCategory  `json:"tax_category"`
+	}
+
+	var query tmp
+	if err = json.Unmarshal(body, &query); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		if err := json.NewEncoder(res).Encode(status); err != nil {
+			res.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		return
+	}
+
+	if err := mongodb.AddProduct(query.Token, query.ProductStock, query.TaxCategory); err != nil {
+		switch {
+		case errors.Is(err, mongodb.ErrInvalidTaxCategory):
+			status.Code = "invalid_tax_category"
+		case errors.Is(err, mongodb.ErrTaxCategoryChange):
+			status.Code = "tax_category_mismatch"
+			res.WriteHeader(http.StatusConflict)
+			_ = json.NewEncoder(res).Encode(status)
+			return
+		}
+		res.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(res).Encode(status)
+		return
+	}
+
+	status.Status = true
+	if err := json.NewEncoder(res).Encode(status); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+}
+
+func ProductTaxCategory(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	status := mongodb.ResponseStatus{Status: false}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	type tmp struct {
+		Token       string              `json:"token"`
+		Id          string              `json:"id"`
+		TaxCategory mongodb.TaxCategory `json:"tax_category"`
+	}
+
+	var query tmp
+	if err = json.Unmarshal(body, &query); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(res).Encode(status)
+		return
+	}
+
+	if err := mongodb.SetProductTaxCategory(query.Id, query.TaxCategory); err != nil {
+		fmt.Println(err)
+		if errors.Is(err, mongodb.ErrInvalidTaxCategory) {
+			status.Code = "invalid_tax_category"
+		}
+		res.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(res).Encode(status)
+		return
+	}
+
+	status.Status = true
+	_ = json.NewEncoder(res).Encode(status)
+}
+
+func ProductPriceOverride(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	status := mongodb.ResponseStatus{Status: false}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	type tmp struct {
+		Token    string                `json:"token"`
+		Id       string                `json:"id"`
+		Override mongodb.PriceOverride `json:"override"`
+	}
+
+	var query tmp
+	if err = json.Unmarshal(body, &query); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(res).Encode(status)
+		return
+	}
+
+	if err := mongodb.AddPriceOverride(query.Id, query.Override); err != nil {
+		fmt.Println(err)
+		switch {
+		case errors.Is(err, mongodb.ErrInvalidPromotion):
+			status.Code = "invalid_override"
+			res.WriteHeader(http.StatusBadRequest)
+		default:
+			res.WriteHeader(http.StatusBadRequest)
+		}
+		_ = json.NewEncoder(res).Encode(status)
+		return
+	}
+
+	status.Status = true
+	_ = json.NewEncoder(res).Encode(status)
+}
+
+func AdminSetTaxRate(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	status := mongodb.ResponseStatus{Status: false}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	type tmp struct {
+		Token    string              `json:"token"`
+		Category mongodb.TaxCategory `json:"category"`
+		Rate     mongodb.TaxRate     `json:"rate"`
+	}
+
+	var query tmp
+	if err = json.Unmarshal(body, &query); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(res).Encode(status)
+		return
+	}
+
+	if err := mongodb.SetTaxRate(query.Category, query.Rate); err != nil {
+		fmt.Println(err)
+		switch {
+		case errors.Is(err, mongodb.ErrInvalidTaxCategory):
+			status.Code = "invalid_tax_category"
+		case errors.Is(err, mongodb.ErrInvalidTaxRate):
+			status.Code = "invalid_tax_rate"
+		}
+		res.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(res).Encode(status)
+		return
+	}
+
+	status.Status = true
+	_ = json.NewEncoder(res).Encode(status)
+}
+
+func AdminSetExchangeRate(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	status := mongodb.ResponseStatus{Status: false}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	type tmp struct {
+		Token string           `json:"token"`
+		From  mongodb.Currency `json:"from"`
+		To    mongodb.Currency `json:"to"`
+		Rate  string           `json:"rate"`
+	}
+
+	var query tmp
+	if err = json.Unmarshal(body, &query); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(res).Encode(status)
+		return
+	}
+
+	rate := mongodb.ExchangeRate{From: query.From, To: query.To, Rate: query.Rate}
+	if err := mongodb.SetExchangeRate(rate); err != nil {
+		fmt.Println(err)
+		switch {
+		case errors.Is(err, mongodb.ErrInvalidCurrency):
+			status.Code = "invalid_currency"
+		case errors.Is(err, mongodb.ErrInvalidRate):
+			status.Code = "invalid_rate"
+		}
+		res.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(res).Encode(status)
+		return
+	}
+
+	status.Status = true
+	_ = json.NewEncoder(res).Encode(status)
+}
+
+func AdminAdjustAccount(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	status := mongodb.ResponseStatus{Status: false}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	type tmp struct {
+		Token    string        `json:"token"`
+		Username string        `json:"username"`
+		Amount   mongodb.Money `json:"amount"`
+		Memo     string        `json:"memo"`
+	}
+
+	var query tmp
+	if err = json.Unmarshal(body, &query); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(res).Encode(status)
+		return
+	}
+
+	session, _ := sessionFrom(req)
+	if err := mongodb.AdjustAccount(session, query.Username, query.Amount, query.Memo); err != nil {
+		fmt.Println(err)
+		switch {
+		case errors.Is(err, mongodb.ErrInvalidAmount):
+			status.Code = "invalid_amount"
+			res.WriteHeader(http.StatusBadRequest)
+		case errors.Is(err, mongodb.ErrInsufficientFunds):
+			status.Code = "insufficient_funds"
+			res.WriteHeader(http.StatusPaymentRequired)
+		default:
+			res.WriteHeader(http.StatusBadRequest)
+		}
+		_ = json.NewEncoder(res).Encode(status)
+		return
+	}
+
+	status.Status = true
+	_ = json.NewEncoder(res).Encode(status)
+}
+
+func AdminSetCreditLimit(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	status := mongodb.ResponseStatus{Status: false}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	type tmp struct {
+		Token       string        `json:"token"`
+		Username    string        `json:"username"`
+		CreditLimit mongodb.Money `json:"credit_limit"`
+	}
+
+	var query tmp
+	if err = json.Unmarshal(body, &query); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(res).Encode(status)
+		return
+	}
+
+	previous, err := mongodb.SetCreditLimit(query.Username, query.CreditLimit)
+	if err != nil {
+		fmt.Println(err)
+		switch {
+		case errors.Is(err, mongodb.ErrInvalidCreditLimit):
+			status.Code = "invalid_credit_limit"
+		case errors.Is(err, mongodb.ErrInvalidCurrency):
+			status.Code = "invalid_currency"
+		}
+		res.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(res).Encode(status)
+		return
+	}
+
+	session, _ := sessionFrom(req)
+	event := mongodb.AuditEvent{
+		Username: session.Username,
+		Action:   "credit_limit_set",
+		Detail:   query.Username + ": " + previous.String() + " to " + query.CreditLimit.String(),
+	}
+	if err := mongodb.InsertAudit(event); err != nil {
+		fmt.Println(err)
+	}
+
+	status.Status = true
+	_ = json.NewEncoder(res).Encode(status)
+}
+
+func AccountGet(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+
+	session, _ := sessionFrom(req)
+	user, err := mongodb.GetUser(session.Username)
+	if err != nil {
+		fmt.Println(err)
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	account, err := mongodb.GetAccountBalance(user.AccountId)
+	if err != nil {
+		fmt.Println(err)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(res).Encode(account); err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func AccountStatement(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	type tmp struct {
+		Token string `json:"token"`
+		mongodb.StatementQuery
+	}
+
+	var query tmp
+	if err = json.Unmarshal(body, &query); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(res).Encode(mongodb.ResponseStatus{Status: false, Code: "invalid_query"})
+		return
+	}
+
+	session, _ := sessionFrom(req)
+	user, err := mongodb.GetUser(session.Username)
+	if err != nil {
+		fmt.Println(err)
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	statement, err := mongodb.GetStatement(user.AccountId, query.StatementQuery)
+	if err != nil {
+		fmt.Println(err)
+		if errors.Is(err, mongodb.ErrInvalidPeriod) {
+			res.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(res).Encode(mongodb.ResponseStatus{Status: false, Code: "invalid_period"})
+			return
+		}
+		if errors.Is(err, mongodb.ErrInvalidPage) {
+			res.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(res).Encode(mongodb.ResponseStatus{Status: false, Code: "invalid_page"})
+			return
+		}
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(res).Encode(statement); err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+type accountMoveQuery struct {
+	Token  string        `json:"token"`
+	From   string        `json:"from"`
+	To     string        `json:"to"`
+	Amount mongodb.Money `json:"amount"`
+	Memo   string        `json:"memo"`
+}
+
+// moveAccountMoney decodes an accountMoveQuery, applies move to the caller's
+// account and answers with the resulting statement line. Money only ever
+// leaves the caller's own account; a different "from" is refused and audited.
+func moveAccountMoney(res http.ResponseWriter, req *http.Request, action string, move func(session mongodb.Session, query accountMoveQuery) (mongodb.StatementLine, error)) {
+	res.Header().Set("Content-Type", "application/json")
+	status := mongodb.ResponseStatus{Status: false}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var query accountMoveQuery
+	if err = json.Unmarshal(body, &query); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(res).Encode(status)
+		return
+	}
+
+	session, _ := sessionFrom(req)
+	if query.From != "" && query.From != session.Username {
+		event := mongodb.AuditEvent{
+			Username: session.Username,
+			Action:   action + "_rejected",
+			Detail:   "account of " + query.From + " is not the caller's",
+		}
+		if err := mongodb.InsertAudit(event); err != nil {
+			fmt.Println(err)
+		}
+
+		res.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(res).Encode(mongodb.ResponseStatus{Status: false, Code: "forbidden"})
+		return
+	}
+
+	line, err := move(session, query)
+	if err != nil {
+		fmt.Println(err)
+		switch {
+		case errors.Is(err, mongodb.ErrForbidden):
+			status.Code = "forbidden"
+			res.WriteHeader(http.StatusForbidden)
+		case errors.Is(err, mongodb.ErrInvalidAmount):
+			status.Code = "invalid_amount"
+			res.WriteHeader(http.StatusBadRequest)
+		case errors.Is(err, mongodb.ErrInvalidMemo):
+			status.Code = "invalid_memo"
+			res.WriteHeader(http.StatusBadRequest)
+		case errors.Is(err, mongodb.ErrInvalidCurrency):
+			status.Code = "invalid_currency"
+			res.WriteHeader(http.StatusBadRequest)
+		case errors.Is(err, mongodb.ErrSameAccount):
+			status.Code = "same_account"
+			res.WriteHeader(http.StatusBadRequest)
+		case errors.Is(err, mongodb.ErrLimitExceeded):
+			status.Code = "limit_exceeded"
+			res.WriteHeader(http.StatusForbidden)
+		case errors.Is(err, mongodb.ErrInsufficientFunds):
+			status.Code = "insufficient_funds"
+			res.WriteHeader(http.StatusPaymentRequired)
+		case errors.Is(err, mongodb.ErrNoExchangeRate):
+			status.Code = "no_exchange_rate"
+			res.WriteHeader(http.StatusConflict)
+		case errors.Is(err, mongodb.ErrTillShort):
+			status.Code = "till_short"
+			res.WriteHeader(http.StatusConflict)
+		default:
+			res.WriteHeader(http.StatusBadRequest)
+		}
+		_ = json.NewEncoder(res).Encode(status)
+		return
+	}
+
+	if err := json.NewEncoder(res).Encode(line); err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// AccountDeposit is taken by a teller: "to" names the user whose account
+// receives the cash.
+func AccountDeposit(res http.ResponseWriter, req *http.Request) {
+	moveAccountMoney(res, req, "account_deposit", func(session mongodb.Session, query accountMoveQuery) (mongodb.StatementLine, error) {
+		return mongodb.Deposit(session, query.To, query.Amount, query.Memo)
+	})
+}
+
+func AccountWithdraw(res http.ResponseWriter, req *http.Request) {
+	moveAccountMoney(res, req, "account_withdraw", func(session mongodb.Session, query accountMoveQuery) (mongodb.StatementLine, error) {
+		return mongodb.Withdraw(session, query.Amount, query.Memo)
+	})
+}
+
+func AccountTransfer(res http.ResponseWriter, req *http.Request) {
+	moveAccountMoney(res, req, "account_transfer", func(session mongodb.Session, query accountMoveQuery) (mongodb.StatementLine, error) {
+		return mongodb.Transfer(session, query.To, query.Amount, query.Memo)
+	})
+}
+
+// TillSettle moves takings out of the till of the seller named in "to" into
+// their account.
+func TillSettle(res http.ResponseWriter, req *http.Request) {
+	moveAccountMoney(res, req, "till_settle", func(session mongodb.Session, query accountMoveQuery) (mongodb.StatementLine, error) {
+		return mongodb.SettleTill(session, query.To, query.Amount, query.Memo)
+	})
+}
+
+func TillGet(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	type tmp struct {
+		Token  string `json:"token"`
+		Seller string `json:"seller"`
 	}
 
 	var query tmp
 	if err = json.Unmarshal(body, &query); err != nil {
 		res.WriteHeader(http.StatusBadRequest)
-		if err := json.NewEncoder(res).Encode(status); err != nil {
-			res.WriteHeader(http.StatusBadRequest)
-			return
-		}
 		return
 	}
 
-	if _, err := mongodb.GetSession(query.Token); err != nil {
-		res.WriteHeader(http.StatusUnauthorized)
+	balance, err := mongodb.TillBalance(query.Seller)
+	if err != nil {
+		fmt.Println(err)
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	type rsp struct {
+		Seller  string          `json:"seller"`
+		Balance []mongodb.Money `json:"balance"`
+	}
+	if err := json.NewEncoder(res).Encode(rsp{Seller: query.Seller, Balance: balance}); err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func PromotionAdd(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	status := mongodb.ResponseStatus{Status: false}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	if err := mongodb.AddProduct(query.Token, query.ProductStock); err != nil {
+	type tmp struct {
+		Token     string            `json:"token"`
+		Promotion mongodb.Promotion `json:"promotion"`
+	}
+
+	var query tmp
+	if err = json.Unmarshal(body, &query); err != nil {
 		res.WriteHeader(http.StatusBadRequest)
 		_ = json.NewEncoder(res).Encode(status)
 		return
 	}
 
-	status.Status = true
-	if err := json.NewEncoder(res).Encode(status); err != nil {
+	if err := mongodb.AddPromotion(query.Promotion); err != nil {
+		fmt.Println(err)
+		if errors.Is(err, mongodb.ErrInvalidPromotion) {
+			status.Code = "invalid_promotion"
+		}
 		res.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(res).Encode(status)
 		return
 	}
+
+	status.Status = true
+	_ = json.NewEncoder(res).Encode(status)
 }
 
 func ProductGet(res http.ResponseWriter, req *http.Request) {
@@ -148,11 +863,6 @@ func ProductGet(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if _, err := mongodb.GetSession(query.Token); err != nil {
-		res.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-
 	if product, err := mongodb.GetProductSecure(query.Token, query.Id); err != nil {
 		res.WriteHeader(http.StatusBadRequest)
 		return
@@ -161,7 +871,9 @@ func ProductGet(res http.ResponseWriter, req *http.Request) {
 			Id:             product.Id,
 			Name:           product.Name,
 			Price:          product.Price,
+			TaxCategory:    product.TaxCategory,
 			TotalAvailable: product.TotalAvailable,
+			TotalReserved:  product.TotalReserved,
 			TotalSold:      product.TotalSold,
 		}
 		if err := json.NewEncoder(res).Encode(ans); err != nil {
@@ -182,6 +894,8 @@ func ReceiptCreate(res http.ResponseWriter, req *http.Request) {
 	type tmp struct {
 		Token    string                   `json:"token" bson:"token"`
 		Products []mongodb.ReceiptProduct `json:"products"`
+		Terminal string                   `json:"terminal"`
+		Coupons  []string                 `json:"coupons"`
 	}
 
 	var query tmp
@@ -190,12 +904,23 @@ func ReceiptCreate(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if _, err := mongodb.GetSession(query.Token); err != nil {
-		res.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-
-	if rec, err := mongodb.CreateReceipt(query.Token, query.Products); err != nil {
+	if rec, err := mongodb.CreateReceipt(query.Token, query.Products, query.Terminal, query.Coupons); err != nil {
+		fmt.Println(err)
+		if errors.Is(err, mongodb.ErrInsufficientStock) {
+			res.WriteHeader(http.StatusConflict)
+			_ = json.NewEncoder(res).Encode(mongodb.ResponseStatus{Status: false, Code: "insufficient_stock"})
+			return
+		}
+		if errors.Is(err, mongodb.ErrInvalidCoupon) {
+			res.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(res).Encode(mongodb.ResponseStatus{Status: false, Code: "invalid_coupon"})
+			return
+		}
+		if errors.Is(err, mongodb.ErrCouponExhausted) {
+			res.WriteHeader(http.StatusConflict)
+			_ = json.NewEncoder(res).Encode(mongodb.ResponseStatus{Status: false, Code: "coupon_exhausted"})
+			return
+		}
 		res.WriteHeader(http.StatusBadRequest)
 		return
 	} else {
@@ -206,6 +931,21 @@ func ReceiptCreate(res http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func rejectConfirm(res http.ResponseWriter, session mongodb.Session, id int, detail string) {
+	event := mongodb.AuditEvent{
+		Username: session.Username,
+		Action:   "receipt_confirm_rejected",
+		Receipt:  mongodb.MyId(id),
+		Detail:   detail,
+	}
+	if err := mongodb.InsertAudit(event); err != nil {
+		fmt.Println(err)
+	}
+
+	res.WriteHeader(http.StatusForbidden)
+	_ = json.NewEncoder(res).Encode(mongodb.ResponseStatus{Status: false, Code: "party_mismatch"})
+}
+
 func ReceiptConfirm(res http.ResponseWriter, req *http.Request) {
 	res.Header().Set("Content-Type", "application/json")
 	status := mongodb.ResponseStatus{Status: false}
@@ -228,29 +968,207 @@ func ReceiptConfirm(res http.ResponseWriter, req *http.Request) {
 		_ = json.NewEncoder(res).Encode(status)
 		return
 	}
-	fmt.Println(query)
 
-	if _, err := mongodb.GetSession(query.Token); err != nil {
+	// the caller pays; "from" and "to" are optional and only checked
+	session, _ := sessionFrom(req)
+	if query.UserFrom != "" && query.UserFrom != session.Username {
+		rejectConfirm(res, session, query.Id, "payer "+query.UserFrom+" is not the caller")
+		return
+	}
+
+	if err := mongodb.ConfirmReceipt(session.Username, query.UserTo, query.Id); err != nil {
 		fmt.Println(err)
-		res.WriteHeader(http.StatusUnauthorized)
+		if errors.Is(err, mongodb.ErrPartyMismatch) {
+			rejectConfirm(res, session, query.Id, err.Error())
+			return
+		}
+
+		code := http.StatusBadRequest
+		var confirmErr *mongodb.ConfirmError
+		if errors.As(err, &confirmErr) {
+			status.Step = string(confirmErr.Step)
+			if confirmErr.Step == mongodb.ConfirmStepCommit {
+				code = http.StatusInternalServerError
+			}
+		}
+		if errors.Is(err, mongodb.ErrReceiptNotOpen) {
+			code = http.StatusConflict
+			status.Code = "receipt_not_open"
+		}
+		if errors.Is(err, mongodb.ErrReceiptExpired) {
+			code = http.StatusConflict
+			status.Code = "receipt_expired"
+		}
+		if errors.Is(err, mongodb.ErrInsufficientFunds) {
+			code = http.StatusPaymentRequired
+			status.Code = "insufficient_funds"
+		}
+		if errors.Is(err, mongodb.ErrInsufficientStock) {
+			code = http.StatusConflict
+			status.Code = "insufficient_stock"
+		}
+		if errors.Is(err, mongodb.ErrCouponExhausted) {
+			code = http.StatusConflict
+			status.Code = "coupon_exhausted"
+		}
+		if errors.Is(err, mongodb.ErrNoExchangeRate) {
+			code = http.StatusConflict
+			status.Code = "no_exchange_rate"
+		}
+		if errors.Is(err, mongodb.ErrReceiptPartlyPaid) {
+			code = http.StatusConflict
+			status.Code = "receipt_partly_paid"
+		}
+
+		res.WriteHeader(code)
+		_ = json.NewEncoder(res).Encode(status)
+		return
+	}
+
+	status.Status = true
+	_ = json.NewEncoder(res).Encode(status)
+}
+
+func VoucherIssue(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	status := mongodb.ResponseStatus{Status: false}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	type tmp struct {
+		Token   string          `json:"token"`
+		Voucher mongodb.Voucher `json:"voucher"`
+	}
+
+	var query tmp
+	if err = json.Unmarshal(body, &query); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
 		_ = json.NewEncoder(res).Encode(status)
 		return
 	}
 
-	if err := mongodb.ConfirmReceipt(query.UserFrom, query.UserTo, query.Id); err != nil {
+	session, _ := sessionFrom(req)
+	voucher, err := mongodb.IssueVoucher(session, query.Voucher)
+	if err != nil {
 		fmt.Println(err)
+		switch {
+		case errors.Is(err, mongodb.ErrInvalidVoucher):
+			status.Code = "invalid_voucher"
+		case errors.Is(err, mongodb.ErrInvalidAmount):
+			status.Code = "invalid_amount"
+		case errors.Is(err, mongodb.ErrInvalidCurrency):
+			status.Code = "invalid_currency"
+		}
+		res.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(res).Encode(status)
+		return
+	}
+
+	res.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(res).Encode(voucher)
+}
+
+func ReceiptPay(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	status := mongodb.ResponseStatus{Status: false}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
+	type tmp struct {
+		Token     string             `json:"token"`
+		Id        int                `json:"id"`
+		Method    mongodb.TenderType `json:"method"`
+		Amount    mongodb.Money      `json:"amount"`
+		Tendered  mongodb.Money      `json:"tendered"`
+		Reference string             `json:"reference"`
+	}
+
+	var query tmp
+	if err = json.Unmarshal(body, &query); err != nil {
 		res.WriteHeader(http.StatusBadRequest)
 		_ = json.NewEncoder(res).Encode(status)
 		return
 	}
 
-	status.Status = true
-	_ = json.NewEncoder(res).Encode(status)
+	payment := mongodb.Payment{
+		Method:    query.Method,
+		Amount:    query.Amount,
+		Tendered:  query.Tendered,
+		Reference: query.Reference,
+	}
+
+	session, _ := sessionFrom(req)
+	receipt, err := mongodb.PayReceipt(session, query.Id, payment)
+	if err != nil {
+		fmt.Println(err)
+		switch {
+		case errors.Is(err, mongodb.ErrPartyMismatch):
+			status.Code = "party_mismatch"
+			res.WriteHeader(http.StatusForbidden)
+		case errors.Is(err, mongodb.ErrForbidden):
+			status.Code = "forbidden"
+			res.WriteHeader(http.StatusForbidden)
+		case errors.Is(err, mongodb.ErrReceiptNotOpen):
+			status.Code = "receipt_not_open"
+			res.WriteHeader(http.StatusConflict)
+		case errors.Is(err, mongodb.ErrReceiptExpired):
+			status.Code = "receipt_expired"
+			res.WriteHeader(http.StatusConflict)
+		case errors.Is(err, mongodb.ErrInvalidTender):
+			status.Code = "invalid_tender"
+			res.WriteHeader(http.StatusBadRequest)
+		case errors.Is(err, mongodb.ErrInvalidAmount):
+			status.Code = "invalid_amount"
+			res.WriteHeader(http.StatusBadRequest)
+		case errors.Is(err, mongodb.ErrOverpayment):
+			status.Code = "overpayment"
+			res.WriteHeader(http.StatusConflict)
+		case errors.Is(err, mongodb.ErrInsufficientFunds):
+			status.Code = "insufficient_funds"
+			res.WriteHeader(http.StatusPaymentRequired)
+		case errors.Is(err, mongodb.ErrInsufficientStock):
+			status.Code = "insufficient_stock"
+			res.WriteHeader(http.StatusConflict)
+		case errors.Is(err, mongodb.ErrCouponExhausted):
+			status.Code = "coupon_exhausted"
+			res.WriteHeader(http.StatusConflict)
+		case errors.Is(err, mongodb.ErrNoExchangeRate):
+			status.Code = "no_exchange_rate"
+			res.WriteHeader(http.StatusConflict)
+		case errors.Is(err, mongodb.ErrInvalidVoucher):
+			status.Code = "invalid_voucher"
+			res.WriteHeader(http.StatusBadRequest)
+		case errors.Is(err, mongodb.ErrVoucherBalance):
+			status.Code = "voucher_balance"
+			res.WriteHeader(http.StatusPaymentRequired)
+		case errors.Is(err, mongodb.ErrReferenceUsed):
+			status.Code = "reference_used"
+			res.WriteHeader(http.StatusConflict)
+		case errors.Is(err, mongodb.ErrInvalidCurrency):
+			status.Code = "invalid_currency"
+			res.WriteHeader(http.StatusBadRequest)
+		default:
+			res.WriteHeader(http.StatusBadRequest)
+		}
+		_ = json.NewEncoder(res).Encode(status)
+		return
+	}
+
+	if err := json.NewEncoder(res).Encode(receipt); err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 }
 
-func ReceiptGet(res http.ResponseWriter, req *http.Request) {
+func ReceiptCancel(res http.ResponseWriter, req *http.Request) {
 	res.Header().Set("Content-Type", "application/json")
+	status := mongodb.ResponseStatus{Status: false}
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		res.WriteHeader(http.StatusBadRequest)
@@ -258,18 +1176,215 @@ func ReceiptGet(res http.ResponseWriter, req *http.Request) {
 	}
 
 	type tmp struct {
-		Token string `json:"token"`
-		Id    int    `json:"id"`
+		Token  string               `json:"token"`
+		Id     int                  `json:"id"`
+		Reason mongodb.CancelReason `json:"reason"`
 	}
 
 	var query tmp
 	if err = json.Unmarshal(body, &query); err != nil {
 		res.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(res).Encode(status)
 		return
 	}
 
-	if _, err := mongodb.GetSession(query.Token); err != nil {
-		res.WriteHeader(http.StatusUnauthorized)
+	session, _ := sessionFrom(req)
+	receipt, err := mongodb.CancelReceipt(session, query.Id, query.Reason)
+	if err != nil {
+		fmt.Println(err)
+		switch {
+		case errors.Is(err, mongodb.ErrForbidden):
+			status.Code = "forbidden"
+			res.WriteHeader(http.StatusForbidden)
+		case errors.Is(err, mongodb.ErrReceiptNotOpen):
+			status.Code = "receipt_not_open"
+			res.WriteHeader(http.StatusConflict)
+		case errors.Is(err, mongodb.ErrInvalidReason):
+			status.Code = "invalid_reason"
+			res.WriteHeader(http.StatusBadRequest)
+		case errors.Is(err, mongodb.ErrReceiptPartlyPaid):
+			status.Code = "receipt_partly_paid"
+			res.WriteHeader(http.StatusConflict)
+		case errors.Is(err, mongodb.ErrInsufficientFunds):
+			status.Code = "insufficient_funds"
+			res.WriteHeader(http.StatusPaymentRequired)
+		default:
+			res.WriteHeader(http.StatusBadRequest)
+		}
+		_ = json.NewEncoder(res).Encode(status)
+		return
+	}
+
+	if err := json.NewEncoder(res).Encode(receipt); err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func ReceiptRefund(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	status := mongodb.ResponseStatus{Status: false}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	type tmp struct {
+		Token  string               `json:"token"`
+		Id     int                  `json:"id"`
+		Lines  []mongodb.RefundLine `json:"lines"`
+		Reason string               `json:"reason"`
+	}
+
+	var query tmp
+	if err = json.Unmarshal(body, &query); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(res).Encode(status)
+		return
+	}
+
+	session, _ := sessionFrom(req)
+	refund, err := mongodb.RefundReceipt(session, query.Id, query.Lines, query.Reason)
+	if err != nil {
+		fmt.Println(err)
+		switch {
+		case errors.Is(err, mongodb.ErrForbidden):
+			status.Code = "forbidden"
+			res.WriteHeader(http.StatusForbidden)
+		case errors.Is(err, mongodb.ErrReceiptNotClosed):
+			status.Code = "receipt_not_closed"
+			res.WriteHeader(http.StatusConflict)
+		case errors.Is(err, mongodb.ErrRefundTooLarge):
+			status.Code = "refund_too_large"
+			res.WriteHeader(http.StatusConflict)
+		case errors.Is(err, mongodb.ErrInsufficientFunds):
+			status.Code = "insufficient_funds"
+			res.WriteHeader(http.StatusPaymentRequired)
+		default:
+			res.WriteHeader(http.StatusBadRequest)
+		}
+		_ = json.NewEncoder(res).Encode(status)
+		return
+	}
+
+	if err := json.NewEncoder(res).Encode(refund); err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+type receiptLineQuery struct {
+	Token    string  `json:"token"`
+	Id       int     `json:"id"`
+	Product  string  `json:"product"`
+	Quantity float32 `json:"quantity"`
+	Coupon   string  `json:"coupon"`
+}
+
+// editReceiptLine decodes a receiptLineQuery, applies edit and answers with the
+// updated receipt.
+func editReceiptLine(res http.ResponseWriter, req *http.Request, edit func(session mongodb.Session, query receiptLineQuery) (mongodb.Receipt, error)) {
+	res.Header().Set("Content-Type", "application/json")
+	status := mongodb.ResponseStatus{Status: false}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var query receiptLineQuery
+	if err = json.Unmarshal(body, &query); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(res).Encode(status)
+		return
+	}
+
+	session, _ := sessionFrom(req)
+	receipt, err := edit(session, query)
+	if err != nil {
+		fmt.Println(err)
+		switch {
+		case errors.Is(err, mongodb.ErrForbidden):
+			status.Code = "forbidden"
+			res.WriteHeader(http.StatusForbidden)
+		case errors.Is(err, mongodb.ErrReceiptNotOpen):
+			status.Code = "receipt_not_open"
+			res.WriteHeader(http.StatusConflict)
+		case errors.Is(err, mongodb.ErrReceiptExpired):
+			status.Code = "receipt_expired"
+			res.WriteHeader(http.StatusConflict)
+		case errors.Is(err, mongodb.ErrInsufficientStock):
+			status.Code = "insufficient_stock"
+			res.WriteHeader(http.StatusConflict)
+		case errors.Is(err, mongodb.ErrLineNotFound):
+			status.Code = "line_not_found"
+			res.WriteHeader(http.StatusNotFound)
+		case errors.Is(err, mongodb.ErrInvalidQuantity):
+			status.Code = "invalid_quantity"
+			res.WriteHeader(http.StatusBadRequest)
+		case errors.Is(err, mongodb.ErrInvalidCoupon):
+			status.Code = "invalid_coupon"
+			res.WriteHeader(http.StatusBadRequest)
+		case errors.Is(err, mongodb.ErrCouponExhausted):
+			status.Code = "coupon_exhausted"
+			res.WriteHeader(http.StatusConflict)
+		case errors.Is(err, mongodb.ErrReceiptPartlyPaid):
+			status.Code = "receipt_partly_paid"
+			res.WriteHeader(http.StatusConflict)
+		default:
+			res.WriteHeader(http.StatusBadRequest)
+		}
+		_ = json.NewEncoder(res).Encode(status)
+		return
+	}
+
+	if err := json.NewEncoder(res).Encode(receipt); err != nil {
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func ReceiptLineAdd(res http.ResponseWriter, req *http.Request) {
+	editReceiptLine(res, req, func(session mongodb.Session, query receiptLineQuery) (mongodb.Receipt, error) {
+		return mongodb.AddReceiptLine(session, query.Id, query.Product, query.Quantity)
+	})
+}
+
+func ReceiptLineUpdate(res http.ResponseWriter, req *http.Request) {
+	editReceiptLine(res, req, func(session mongodb.Session, query receiptLineQuery) (mongodb.Receipt, error) {
+		return mongodb.SetReceiptLineQuantity(session, query.Id, query.Product, query.Quantity)
+	})
+}
+
+func ReceiptLineRemove(res http.ResponseWriter, req *http.Request) {
+	editReceiptLine(res, req, func(session mongodb.Session, query receiptLineQuery) (mongodb.Receipt, error) {
+		return mongodb.RemoveReceiptLine(session, query.Id, query.Product)
+	})
+}
+
+func ReceiptCoupon(res http.ResponseWriter, req *http.Request) {
+	editReceiptLine(res, req, func(session mongodb.Session, query receiptLineQuery) (mongodb.Receipt, error) {
+		return mongodb.ApplyCoupon(session, query.Id, query.Coupon)
+	})
+}
+
+func ReceiptGet(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	type tmp struct {
+		Token string `json:"token"`
+		Id    int    `json:"id"`
+	}
+
+	var query tmp
+	if err = json.Unmarshal(body, &query); err != nil {
+		res.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
@@ -280,33 +1395,93 @@ func ReceiptGet(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	session, _ := sessionFrom(req)
+	if !receipt.VisibleTo(session) {
+		res.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(res).Encode(mongodb.ResponseStatus{Status: false, Code: "forbidden"})
+		return
+	}
+
 	type ans struct {
-		Id         mongodb.MyId             `json:"id" bson:"id"`
-		Products   []mongodb.ReturnProductF `json:"products" bson:"products"`
-		TotalPrice float32                  `json:"total" bson:"total"`
-		Status     mongodb.ReceiptStatus    `json:"status" bson:"status"`
+		Id          mongodb.MyId               `json:"id" bson:"id"`
+		Number      string                     `json:"number,omitempty" bson:"number"`
+		Seller      string                     `json:"seller" bson:"seller"`
+		Buyer       string                     `json:"buyer,omitempty" bson:"buyer"`
+		Terminal    string                     `json:"terminal,omitempty" bson:"terminal"`
+		CreatedAt   time.Time                  `json:"created_at" bson:"created_at"`
+		ConfirmedAt *time.Time                 `json:"confirmed_at,omitempty" bson:"confirmed_at"`
+		Products    []mongodb.ReturnProductF   `json:"products" bson:"products"`
+		Subtotal    mongodb.Money              `json:"subtotal" bson:"subtotal"`
+		Discount    mongodb.Money              `json:"discount" bson:"discount"`
+		Coupons     []string                   `json:"coupons,omitempty" bson:"coupons"`
+		Promotions  []mongodb.AppliedPromotion `json:"promotions,omitempty" bson:"promotions"`
+		Net         mongodb.Money              `json:"net" bson:"net"`
+		Tax         mongodb.Money              `json:"tax" bson:"tax"`
+		Taxes       []mongodb.TaxTotal         `json:"taxes,omitempty" bson:"taxes"`
+		TotalPrice  mongodb.Money              `json:"total" bson:"total"`
+		Payments    []mongodb.Payment          `json:"payments,omitempty" bson:"payments"`
+		Paid        mongodb.Money              `json:"paid" bson:"paid"`
+		Conversions []mongodb.Conversion       `json:"conversions,omitempty" bson:"conversions"`
+		Status      mongodb.ReceiptStatus      `json:"status" bson:"status"`
 	}
 
 	var rsp ans
 	rsp.Id = receipt.Id
+	rsp.Number = receipt.Number
+	rsp.Seller = receipt.Seller
+	rsp.Buyer = receipt.Buyer
+	rsp.Terminal = receipt.Terminal
+	rsp.CreatedAt = receipt.CreatedAt
+	rsp.ConfirmedAt = receipt.ConfirmedAt
+	rsp.Subtotal = receipt.Subtotal
+	rsp.Discount = receipt.Discount
+	rsp.Coupons = receipt.Coupons
+	rsp.Promotions = receipt.Promotions
+	rsp.Net = receipt.Net
+	rsp.Tax = receipt.Tax
+	rsp.Taxes = receipt.Taxes
 	rsp.TotalPrice = receipt.TotalPrice
+	rsp.Payments = receipt.Payments
+	rsp.Paid = receipt.Paid
+	rsp.Conversions = receipt.Conversions
 	rsp.Status = receipt.Status
 
 	for _, obj := range receipt.Products {
-		if prod, err := mongodb.GetProduct(obj.Id); err != nil {
-			res.WriteHeader(http.StatusInternalServerError)
-			return
-		} else {
-			newProd := mongodb.ReturnProductF{
-				Id:             prod.Id,
-				Name:           prod.Name,
-				Price:          prod.Price,
-				Quantity:       int(math.Round(float64(obj.Quantity))),
-				TotalAvailable: obj.Quantity,
-				TotalSold:      prod.TotalSold,
+		newProd := mongodb.ReturnProductF{
+			Id:          obj.Id,
+			Name:        obj.Name,
+			Price:       obj.UnitPrice,
+			Quantity:    obj.Quantity,
+			TaxCategory: obj.TaxCategory,
+			TaxRate:     obj.TaxRate,
+			Tax:         obj.Tax,
+			Discount:    obj.Discount,
+			LineTotal:   obj.LineTotal,
+		}
+
+		// receipts created before lines were snapshotted only have id and quantity
+		if obj.Name == "" && obj.LineTotal.IsZero() {
+			if prod, err := mongodb.GetProduct(obj.Id); err != nil {
+				res.WriteHeader(http.StatusInternalServerError)
+				return
+			} else {
+				newProd.Name = prod.Name
+				newProd.Price = prod.Price
+				newProd.TaxCategory = prod.TaxCategory
+				if newProd.TaxRate, err = mongodb.GetTaxRate(prod.TaxCategory); err != nil {
+					res.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				newProd.LineTotal, _ = prod.Price.MulQuantity(obj.Quantity)
 			}
-			rsp.Products = append(rsp.Products, newProd)
 		}
+
+		rsp.Products = append(rsp.Products, newProd)
+	}
+
+	// receipts priced before promotions existed have no subtotal
+	if rsp.Subtotal.IsZero() && rsp.Discount.IsZero() {
+		rsp.Subtotal = rsp.TotalPrice
 	}
 
 	if err := json.NewEncoder(res).Encode(rsp); err != nil {
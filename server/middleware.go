@@ -0,0 +1,178 @@
+package server
+
+import (
+	"banking/mongodb"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+type contextKey int
+
+const sessionKey contextKey = 0
+
+// sessionFrom returns the session Authorize attached to the request.
+func sessionFrom(req *http.Request) (mongodb.Session, bool) {
+	session, ok := req.Context().Value(sessionKey).(mongodb.Session)
+	return session, ok
+}
+
+// Authorize only lets requests through whose body carries the token of a live
+// session with one of the given profiles: 401 without a session, 403 with the
+// wrong profile. The profile comes from the stored user, set at login.
+func Authorize(profiles ...mongodb.ProfileType) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(res http.ResponseWriter, req *http.Request) {
+			res.Header().Set("Content-Type", "application/json")
+			status := mongodb.ResponseStatus{Status: false}
+
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				res.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			type tmp struct {
+				Token string `json:"token"`
+			}
+
+			var query tmp
+			if err = json.Unmarshal(body, &query); err != nil {
+				res.WriteHeader(http.StatusBadRequest)
+				_ = json.NewEncoder(res).Encode(status)
+				return
+			}
+
+			session, err := mongodb.GetSession(query.Token)
+			if err != nil {
+				res.WriteHeader(http.StatusUnauthorized)
+				_ = json.NewEncoder(res).Encode(status)
+				return
+			}
+
+			allowed := false
+			for _, profile := range profiles {
+				if session.Profile == profile {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				event := mongodb.AuditEvent{
+					Username: session.Username,
+					Action:   "forbidden",
+					Detail:   req.URL.Path,
+				}
+				if err := mongodb.InsertAudit(event); err != nil {
+					fmt.Println(err)
+				}
+				status.Code = "forbidden"
+				res.WriteHeader(http.StatusForbidden)
+				_ = json.NewEncoder(res).Encode(status)
+				return
+			}
+
+			next(res, req.WithContext(context.WithValue(req.Context(), sessionKey, session)))
+		}
+	}
+}
+
+type responseRecorder struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// Idempotent replays the stored response when a request is retried with the
+// same Idempotency-Key header. Requests without the header are passed through.
+func Idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(res, req)
+			return
+		}
+
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			res.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		sum := sha256.Sum256(body)
+		bodyHash := hex.EncodeToString(sum[:])
+
+		// keys are per user, so one user cannot replay another's response;
+		// without a session (registration) only the identical body, password
+		// included, replays it
+		route := req.URL.Path
+		if session, ok := sessionFrom(req); ok {
+			route = session.Username + ":" + route
+		}
+
+		record, reserved, err := mongodb.ReserveIdempotencyKey(key, route, bodyHash)
+		if err != nil {
+			fmt.Println(err)
+			res.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if !reserved {
+			if record.BodyHash != bodyHash {
+				// same key reused for a different request
+				res.WriteHeader(http.StatusUnprocessableEntity)
+				return
+			}
+			if !record.Done {
+				// the first attempt is still running
+				res.WriteHeader(http.StatusConflict)
+				return
+			}
+
+			res.Header().Set("Content-Type", "application/json")
+			res.Header().Set("Idempotent-Replayed", "true")
+			res.WriteHeader(record.Code)
+			_, _ = res.Write(record.Body)
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: res}
+		next(recorder, req)
+
+		if recorder.code == 0 {
+			recorder.code = http.StatusOK
+		}
+
+		// server errors are not stored so the client can retry them
+		if recorder.code >= http.StatusInternalServerError {
+			err = mongodb.ReleaseIdempotencyKey(key, route)
+		} else {
+			err = mongodb.CompleteIdempotencyKey(key, route, recorder.code, recorder.body.Bytes())
+		}
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"banking/mongodb"
 	"fmt"
 	"github.com/gorilla/mux"
 	"log"
@@ -10,13 +11,48 @@ import (
 func RunServer(port string) {
 	router := mux.NewRouter()
 
+	anyone := Authorize(mongodb.ProfileTypeBuyer, mongodb.ProfileTypeSeller, mongodb.ProfileTypeAdmin, mongodb.ProfileTypeManager)
+	buyer := Authorize(mongodb.ProfileTypeBuyer)
+	seller := Authorize(mongodb.ProfileTypeSeller)
+	admin := Authorize(mongodb.ProfileTypeAdmin)
+	sellerOrManager := Authorize(mongodb.ProfileTypeSeller, mongodb.ProfileTypeManager)
+	adminOrManager := Authorize(mongodb.ProfileTypeAdmin, mongodb.ProfileTypeManager)
+	buyerOrSeller := Authorize(mongodb.ProfileTypeBuyer, mongodb.ProfileTypeSeller)
+
 	router.HandleFunc("/api/test", TestHandler).Methods("POST")
 	router.HandleFunc("/api/login", LoginHandler).Methods("POST")
-	router.HandleFunc("/api/product/add", ProductAdd).Methods("POST")
-	router.HandleFunc("/api/product/get", ProductGet).Methods("POST")
-	router.HandleFunc("/api/receipt/create", ReceiptCreate).Methods("POST")
-	router.HandleFunc("/api/receipt/confirm", ReceiptConfirm).Methods("POST")
-	router.HandleFunc("/api/receipt/get", ReceiptGet).Methods("POST")
+	router.HandleFunc("/api/logout", LogoutHandler).Methods("POST")
+	router.HandleFunc("/api/logout/all", anyone(LogoutAllHandler)).Methods("POST")
+	router.HandleFunc("/api/user/register", Idempotent(UserRegister)).Methods("POST")
+	router.HandleFunc("/api/admin/user/register", admin(Idempotent(AdminUserRegister))).Methods("POST")
+	router.HandleFunc("/api/admin/user/password", admin(Idempotent(AdminResetPassword))).Methods("POST")
+	router.HandleFunc("/api/admin/tax/rate", admin(Idempotent(AdminSetTaxRate))).Methods("POST")
+	router.HandleFunc("/api/admin/exchange/rate", admin(Idempotent(AdminSetExchangeRate))).Methods("POST")
+	router.HandleFunc("/api/admin/account/adjust", admin(Idempotent(AdminAdjustAccount))).Methods("POST")
+	router.HandleFunc("/api/admin/account/credit", admin(Idempotent(AdminSetCreditLimit))).Methods("POST")
+	router.HandleFunc("/api/account/get", anyone(AccountGet)).Methods("POST")
+	router.HandleFunc("/api/account/statement", anyone(AccountStatement)).Methods("POST")
+	router.HandleFunc("/api/account/deposit", adminOrManager(Idempotent(AccountDeposit))).Methods("POST")
+	router.HandleFunc("/api/account/withdraw", anyone(Idempotent(AccountWithdraw))).Methods("POST")
+	router.HandleFunc("/api/account/transfer", anyone(Idempotent(AccountTransfer))).Methods("POST")
+	router.HandleFunc("/api/till/get", adminOrManager(TillGet)).Methods("POST")
+	router.HandleFunc("/api/till/settle", adminOrManager(Idempotent(TillSettle))).Methods("POST")
+	router.HandleFunc("/api/product/add", seller(Idempotent(ProductAdd))).Methods("POST")
+	router.HandleFunc("/api/product/price", sellerOrManager(Idempotent(ProductPriceOverride))).Methods("POST")
+	router.HandleFunc("/api/product/tax", adminOrManager(Idempotent(ProductTaxCategory))).Methods("POST")
+	router.HandleFunc("/api/product/get", anyone(ProductGet)).Methods("POST")
+	router.HandleFunc("/api/promotion/add", adminOrManager(Idempotent(PromotionAdd))).Methods("POST")
+	router.HandleFunc("/api/voucher/issue", adminOrManager(Idempotent(VoucherIssue))).Methods("POST")
+	router.HandleFunc("/api/receipt/create", seller(Idempotent(ReceiptCreate))).Methods("POST")
+	router.HandleFunc("/api/receipt/line/add", seller(Idempotent(ReceiptLineAdd))).Methods("POST")
+	router.HandleFunc("/api/receipt/line/update", seller(Idempotent(ReceiptLineUpdate))).Methods("POST")
+	router.HandleFunc("/api/receipt/line/remove", seller(Idempotent(ReceiptLineRemove))).Methods("POST")
+	router.HandleFunc("/api/receipt/coupon", seller(Idempotent(ReceiptCoupon))).Methods("POST")
+	router.HandleFunc("/api/receipt/confirm", buyer(Idempotent(ReceiptConfirm))).Methods("POST")
+	router.HandleFunc("/api/receipt/pay", buyerOrSeller(Idempotent(ReceiptPay))).Methods("POST")
+	router.HandleFunc("/api/receipt/cancel", sellerOrManager(Idempotent(ReceiptCancel))).Methods("POST")
+	router.HandleFunc("/api/receipt/refund", sellerOrManager(Idempotent(ReceiptRefund))).Methods("POST")
+	router.HandleFunc("/api/receipt/get", anyone(ReceiptGet)).Methods("POST")
 
 	fmt.Println("Server starting on port " + port + "...")
 	log.Fatal(http.ListenAndServe(":"+port, router))